@@ -0,0 +1,82 @@
+package dta
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrInvalidAttribute is returned when a string isn't an RFC 1464 attribute
+var ErrInvalidAttribute = errors.New("invalid attribute")
+
+// Attribute is a single name/value pair from a TXT record
+type Attribute struct {
+	Name  string
+	Value string
+	// TTL of the record the attribute came from, zero if parsed from a string
+	TTL uint32
+}
+
+// Parse splits an RFC 1464 "name=value" string into its attribute. The name
+// ends at the first unquoted "=" and may use "`" to quote the following
+// character. Unquoted leading and trailing spaces and tabs in the name are
+// ignored. The value is taken literally.
+func Parse(s string) (attribute Attribute, err error) {
+	var name []byte
+	// Length of the name up to and including its last quoted character,
+	// which limits how much trailing whitespace can be trimmed
+	var quotedEnd int
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '`':
+			if i+1 >= len(s) {
+				err = fmt.Errorf("%w: %q ends with an unfinished quote", ErrInvalidAttribute, s)
+				return
+			}
+			i++
+			name = append(name, s[i])
+			quotedEnd = len(name)
+		case c == '=':
+			attribute.Name = trimName(name, quotedEnd)
+			attribute.Value = s[i+1:]
+			if attribute.Name == "" {
+				err = fmt.Errorf("%w: %q has no name", ErrInvalidAttribute, s)
+			}
+			return
+		case (c == ' ' || c == '\t') && len(name) == 0:
+			// Unquoted leading whitespace is ignored
+		default:
+			name = append(name, c)
+		}
+	}
+	err = fmt.Errorf("%w: %q has no unquoted \"=\"", ErrInvalidAttribute, s)
+	return
+}
+
+// Drops unquoted trailing whitespace from the name
+func trimName(name []byte, quotedEnd int) string {
+	end := len(name)
+	for end > quotedEnd && (name[end-1] == ' ' || name[end-1] == '\t') {
+		end--
+	}
+	return string(name[:end])
+}
+
+// Encode returns the RFC 1464 string for an attribute, quoting
+// the characters in name that Parse would otherwise interpret
+func Encode(name, value string) string {
+	var b strings.Builder
+	// Whitespace is only significant at either end of the name
+	leading := len(name) - len(strings.TrimLeft(name, " \t"))
+	trailing := len(strings.TrimRight(name, " \t"))
+	for i := 0; i < len(name); i++ {
+		c := name[i]
+		if c == '`' || c == '=' || i < leading || i >= trailing {
+			b.WriteByte('`')
+		}
+		b.WriteByte(c)
+	}
+	b.WriteByte('=')
+	b.WriteString(value)
+	return b.String()
+}
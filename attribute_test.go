@@ -0,0 +1,97 @@
+package dta
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseWhitespace(t *testing.T) {
+	for s, expected := range map[string]Attribute{
+		" abc =1":        {Name: "abc", Value: "1"},
+		"\tabc\t=1":      {Name: "abc", Value: "1"},
+		"` abc=1":        {Name: " abc", Value: "1"},
+		"abc` =1":        {Name: "abc ", Value: "1"},
+		"abc`  =1":       {Name: "abc ", Value: "1"},
+		"a  b=1":         {Name: "a  b", Value: "1"},
+		"` ` =1":         {Name: "  ", Value: "1"},
+		"key= spaced  ":  {Name: "key", Value: " spaced  "},
+		"a``b=c``d":      {Name: "a`b", Value: "c``d"},
+		"`a`b=c":         {Name: "ab", Value: "c"},
+		"key=value=more": {Name: "key", Value: "value=more"},
+	} {
+		attribute, err := Parse(s)
+		if err != nil {
+			t.Errorf("Unexpected error parsing %q: %v", s, err)
+			continue
+		}
+		if attribute != expected {
+			t.Errorf("Expected %q to parse as %+v, got %+v", s, expected, attribute)
+		}
+	}
+}
+
+func TestParseInvalid(t *testing.T) {
+	for _, s := range []string{"", "novalue", "=value", " =value", "a`=b", "abc`"} {
+		if _, err := Parse(s); !errors.Is(err, ErrInvalidAttribute) {
+			t.Errorf("Expected ErrInvalidAttribute for %q, got: %v", s, err)
+		}
+	}
+}
+
+func TestEncode(t *testing.T) {
+	for expected, attribute := range map[string]Attribute{
+		"color=blue":      {Name: "color", Value: "blue"},
+		"a`=a=true":       {Name: "a=a", Value: "true"},
+		"`==\\=":          {Name: "=", Value: "\\="},
+		"string2=``abc``": {Name: "string2", Value: "``abc``"},
+		"a b=c d":         {Name: "a b", Value: "c d"},
+		"abc` =123 ":      {Name: "abc ", Value: "123 "},
+		"` abc=1":         {Name: " abc", Value: "1"},
+		"a``b=1":          {Name: "a`b", Value: "1"},
+		"` `\t=1":         {Name: " \t", Value: "1"},
+	} {
+		if s := Encode(attribute.Name, attribute.Value); s != expected {
+			t.Errorf("Expected %+v to encode as %q, got %q", attribute, expected, s)
+		}
+	}
+}
+
+func FuzzParseEncode(f *testing.F) {
+	f.Add("color", "blue")
+	f.Add("a=a", "true")
+	f.Add(" abc ", " 123 ")
+	f.Add("`", "``")
+	f.Add("\t=\t", "=")
+	f.Fuzz(func(t *testing.T, name, value string) {
+		if name == "" {
+			t.Skip()
+		}
+		attribute, err := Parse(Encode(name, value))
+		if err != nil {
+			t.Fatalf("Failed to parse encoded %q=%q: %v", name, value, err)
+		}
+		if attribute.Name != name || attribute.Value != value {
+			t.Errorf("Expected %q=%q, got %q=%q", name, value, attribute.Name, attribute.Value)
+		}
+	})
+}
+
+func FuzzParse(f *testing.F) {
+	for _, s := range []string{"color=blue", "a`=a=true", "a\\`=a=false", "`==\\=", "abc` =123 ", "novalue"} {
+		f.Add(s)
+	}
+	f.Fuzz(func(t *testing.T, s string) {
+		attribute, err := Parse(s)
+		if err != nil {
+			return
+		}
+		// Anything parsed has to survive a round trip through Encode
+		again, err := Parse(Encode(attribute.Name, attribute.Value))
+		if err != nil {
+			t.Fatalf("Failed to parse re-encoded %q: %v", s, err)
+		}
+		if again != attribute {
+			t.Errorf("Expected %+v after round trip, got %+v", attribute, again)
+		}
+	})
+}
@@ -0,0 +1,117 @@
+package dta
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Port the zone's authoritative nameservers are queried on by default
+const defaultAuthoritativePort = 53
+
+var (
+	// ErrNotAuthoritative is matched when a nameserver queried in
+	// Authoritative mode answers without the AA bit
+	ErrNotAuthoritative = errors.New("answer is not authoritative")
+	// ErrNoNameServers is returned when the zone's authoritative nameservers can't be found
+	ErrNoNameServers = errors.New("no authoritative nameservers found")
+)
+
+// Returns a copy of req that queries the authoritative nameservers for
+// the zone containing its domain, found using req's nameservers
+func (req request) authoritativeRequest(ctx context.Context) (direct request, err error) {
+	nameservers, err := authoritativeNameServers(ctx, req)
+	if err != nil {
+		return
+	}
+	direct = req
+	direct.NameServers = nameservers
+	direct.Discovery = nil
+	direct.Authoritative = false
+	direct.direct = true
+	return
+}
+
+// Finds the zone's NS records and the addresses of the nameservers they
+// name, using glue from the answer where there is some
+func authoritativeNameServers(ctx context.Context, req request) (nameservers NameServers, err error) {
+	record, _, _, err := query(ctx, req, newQuery(req, req.Domain, dns.TypeNS))
+	if err != nil {
+		return
+	}
+	names := nsNames(record)
+	if len(names) == 0 {
+		// Below the zone apex the answer has the zone's SOA in the authority section
+		for _, rr := range record.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				if record, _, _, err = query(ctx, req, newQuery(req, soa.Hdr.Name, dns.TypeNS)); err != nil {
+					return
+				}
+				names = nsNames(record)
+				break
+			}
+		}
+	}
+	glue := make(map[string][]string)
+	for _, rr := range record.Extra {
+		switch rr := rr.(type) {
+		case *dns.A:
+			glue[strings.ToLower(rr.Hdr.Name)] = append(glue[strings.ToLower(rr.Hdr.Name)], rr.A.String())
+		case *dns.AAAA:
+			glue[strings.ToLower(rr.Hdr.Name)] = append(glue[strings.ToLower(rr.Hdr.Name)], rr.AAAA.String())
+		}
+	}
+	port := req.AuthoritativePort
+	if port == 0 {
+		port = defaultAuthoritativePort
+	}
+	seen := make(map[string]bool)
+	for _, name := range names {
+		addresses, ok := glue[strings.ToLower(name)]
+		if !ok {
+			addresses = nameServerAddresses(ctx, req, name)
+		}
+		for _, address := range addresses {
+			if !seen[address] {
+				seen[address] = true
+				nameservers = append(nameservers, NameServer{Host: address, Port: port})
+			}
+		}
+	}
+	if len(nameservers) == 0 {
+		err = ErrNoNameServers
+	}
+	return
+}
+
+// Returns the nameservers named by the NS records in the answer
+func nsNames(record *dns.Msg) (names []string) {
+	for _, rr := range record.Answer {
+		if ns, ok := rr.(*dns.NS); ok {
+			names = append(names, ns.Ns)
+		}
+	}
+	return
+}
+
+// Looks up the IPv4 and IPv6 addresses of a nameserver, ignoring failures
+// as another nameserver may still be reachable
+func nameServerAddresses(ctx context.Context, req request, name string) (addresses []string) {
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		record, _, _, err := query(ctx, req, newQuery(req, name, qtype))
+		if err != nil {
+			continue
+		}
+		for _, rr := range record.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addresses = append(addresses, rr.A.String())
+			case *dns.AAAA:
+				addresses = append(addresses, rr.AAAA.String())
+			}
+		}
+	}
+	return
+}
@@ -0,0 +1,119 @@
+package dta
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+// Returns a handler acting as a recursive resolver for the example.com
+// zone served by ns1 and ns2, with glue for ns1 only if glue is set. TXT
+// queries get a stale answer.
+func bootstrapHandler(glue bool) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.RecursionAvailable = true
+		q := r.Question[0]
+		header := dns.RR_Header{Name: q.Name, Rrtype: q.Qtype, Class: dns.ClassINET, Ttl: 300}
+		switch {
+		case q.Qtype == dns.TypeNS && q.Name == "example.com.":
+			m.Answer = append(m.Answer,
+				&dns.NS{Hdr: header, Ns: "ns1.example.com."},
+				&dns.NS{Hdr: header, Ns: "ns2.example.com."})
+			if glue {
+				m.Extra = append(m.Extra, &dns.A{
+					Hdr: dns.RR_Header{Name: "ns1.example.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+					A:   net.ParseIP("127.0.0.1"),
+				})
+			}
+		case q.Qtype == dns.TypeNS:
+			m.Ns = append(m.Ns, &dns.SOA{
+				Hdr: dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+				Ns:  "ns1.example.com.", Mbox: "hostmaster.example.com.", Serial: 1, Minttl: 60,
+			})
+		case q.Name == "ns1.example.com." || q.Name == "ns2.example.com.":
+			if q.Qtype == dns.TypeA {
+				m.Answer = append(m.Answer, &dns.A{Hdr: header, A: net.ParseIP("127.0.0.1")})
+			}
+		case q.Qtype == dns.TypeTXT:
+			m.Answer = append(m.Answer, &dns.TXT{Hdr: header, Txt: []string{"color=stale"}})
+		}
+		w.WriteMsg(m)
+	}
+}
+
+// Returns a handler answering TXT queries as an authoritative nameserver
+// would, recording whether recursion was asked for
+func authoritativeHandler(authoritative bool, recursionDesired *atomic.Bool) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		recursionDesired.Store(r.RecursionDesired)
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = authoritative
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{"color=fresh"},
+		})
+		w.WriteMsg(m)
+	}
+}
+
+func TestAuthoritative(t *testing.T) {
+	var recursionDesired atomic.Bool
+	authoritative := startServer(t, authoritativeHandler(true, &recursionDesired))
+	request := NewRequest("config.example.com", startServer(t, bootstrapHandler(false)))
+	request.Authoritative = true
+	request.AuthoritativePort = authoritative.Port
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Expected response, got: %v", err)
+	}
+	if res.Config["color"] != "fresh" || !res.Authoritative {
+		t.Errorf("Expected authoritative color=fresh, got %v", res.Config)
+	}
+	if res.NameServer.Host != "127.0.0.1" || res.NameServer.Port != authoritative.Port {
+		t.Errorf("Expected answer from the authoritative nameserver, got %+v", res.NameServer)
+	}
+	if recursionDesired.Load() {
+		t.Errorf("Expected RD to be cleared")
+	}
+}
+
+func TestAuthoritativeGlue(t *testing.T) {
+	var recursionDesired atomic.Bool
+	authoritative := startServer(t, authoritativeHandler(true, &recursionDesired))
+	request := NewRequest("example.com", startServer(t, bootstrapHandler(true)))
+	request.AuthoritativePort = authoritative.Port
+	nameservers, err := authoritativeNameServers(context.Background(), request)
+	if err != nil {
+		t.Fatalf("Expected nameservers, got: %v", err)
+	}
+	// Both nameservers have the same address so it's only listed once
+	if len(nameservers) != 1 || nameservers[0].Host != "127.0.0.1" || nameservers[0].Port != authoritative.Port {
+		t.Errorf("Expected 127.0.0.1 once, got %+v", nameservers)
+	}
+}
+
+func TestAuthoritativeRequiresAA(t *testing.T) {
+	var recursionDesired atomic.Bool
+	authoritative := startServer(t, authoritativeHandler(false, &recursionDesired))
+	request := NewRequest("config.example.com", startServer(t, bootstrapHandler(true)))
+	request.Authoritative = true
+	request.AuthoritativePort = authoritative.Port
+	if _, err := request.Get(); !errors.Is(err, ErrNotAuthoritative) {
+		t.Errorf("Expected ErrNotAuthoritative, got: %v", err)
+	}
+}
+
+func TestAuthoritativeNoNameServers(t *testing.T) {
+	request := NewRequest("example.org", startServer(t, txtHandler("color=blue")))
+	request.Authoritative = true
+	if _, err := request.Get(); !errors.Is(err, ErrNoNameServers) {
+		t.Errorf("Expected ErrNoNameServers, got: %v", err)
+	}
+}
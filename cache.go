@@ -0,0 +1,270 @@
+package dta
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Cache keeps responses until their TTL expires so repeated lookups
+// don't reach the network. NXDOMAIN answers are cached for the SOA
+// minimum (RFC 2308). Expired responses can be served while nameservers
+// are failing (RFC 8767). A Cache is safe for concurrent use and can be
+// shared between requests.
+type Cache struct {
+	// MinTTL and MaxTTL clamp how long entries are kept. Zero means no limit.
+	MinTTL time.Duration
+	MaxTTL time.Duration
+	// MaxStale is how long past expiry a response is kept to be served,
+	// marked Stale, when every nameserver fails. Zero disables serving stale data.
+	MaxStale time.Duration
+	// StaleWhileRevalidate serves stale responses straight away
+	// while they're refreshed in the background
+	StaleWhileRevalidate bool
+
+	mu       sync.Mutex
+	entries  map[string]*cacheEntry
+	inflight map[string]*cacheCall
+	now      func() time.Time
+}
+
+type cacheEntry struct {
+	response Response
+	err      error
+	expires  time.Time
+}
+
+// A lookup in progress that other callers for the same key wait on
+type cacheCall struct {
+	done     chan struct{}
+	response Response
+	err      error
+}
+
+// NewCache returns a cache that keeps entries for at least minTTL and at most maxTTL
+func NewCache(minTTL, maxTTL time.Duration) *Cache {
+	return &Cache{MinTTL: minTTL, MaxTTL: maxTTL}
+}
+
+// Purge removes every entry
+func (c *Cache) Purge() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.entries = nil
+}
+
+// Removes the entry for req so the next lookup reaches the nameservers
+func (c *Cache) invalidate(req request) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.entries, cacheKey(req))
+}
+
+func (c *Cache) clock() time.Time {
+	if c.now != nil {
+		return c.now()
+	}
+	return time.Now()
+}
+
+// Returns the cached result for req, looking it up if missing or expired.
+// Concurrent misses for the same key share a single lookup.
+func (c *Cache) get(ctx context.Context, req request) (response Response, err error) {
+	key := cacheKey(req)
+	c.mu.Lock()
+	now := c.clock()
+	entry, ok := c.entries[key]
+	if ok && now.Before(entry.expires) {
+		c.mu.Unlock()
+		return entry.response.clone(), entry.err
+	}
+	stale := ok && entry.servableStale(now, c.MaxStale)
+	call, ok := c.inflight[key]
+	if !ok {
+		call = &cacheCall{done: make(chan struct{})}
+		if c.inflight == nil {
+			c.inflight = make(map[string]*cacheCall)
+		}
+		c.inflight[key] = call
+		// Run detached from the caller so waiters aren't failed by its cancellation
+		go c.fill(ctx, req, key, call)
+	}
+	c.mu.Unlock()
+	if stale && c.StaleWhileRevalidate {
+		return entry.staleResponse(), nil
+	}
+	select {
+	case <-call.done:
+		if stale && unreachable(call.err) {
+			return entry.staleResponse(), nil
+		}
+		return call.response.clone(), call.err
+	case <-ctx.Done():
+		if stale {
+			return entry.staleResponse(), nil
+		}
+		err = &LookupError{Domain: dns.Fqdn(req.Domain), Err: contextError(ctx)}
+		return
+	}
+}
+
+// Reports whether err means no nameserver answered, so an earlier answer
+// can stand in. Errors in the answers themselves, such as NXDOMAIN, a
+// duplicate attribute or failed DNSSEC validation, aren't masked.
+func unreachable(err error) bool {
+	if err == nil || errors.Is(err, ErrNXDOMAIN) {
+		return false
+	}
+	return errors.Is(err, ErrAllServersFailed) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// Reports whether an expired entry is a response that can still be served
+func (e *cacheEntry) servableStale(now time.Time, maxStale time.Duration) bool {
+	return e.err == nil && now.Before(e.expires.Add(maxStale))
+}
+
+// Returns a copy of the entry's response marked as stale
+func (e *cacheEntry) staleResponse() Response {
+	response := e.response.clone()
+	response.Stale = true
+	return response
+}
+
+// Performs the lookup for key and stores the result
+func (c *Cache) fill(ctx context.Context, req request, key string, call *cacheCall) {
+	ctx = context.WithoutCancel(ctx)
+	call.response, call.err = req.lookup(ctx)
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.inflight, key)
+	now := c.clock()
+	// Entries too old to serve would only be replaced, so drop them while here
+	for k, entry := range c.entries {
+		if !now.Before(entry.expires) && !entry.servableStale(now, c.MaxStale) {
+			delete(c.entries, k)
+		}
+	}
+	if ttl, ok := c.ttl(call.response, call.err); ok {
+		if c.entries == nil {
+			c.entries = make(map[string]*cacheEntry)
+		}
+		c.entries[key] = &cacheEntry{response: call.response, err: call.err, expires: now.Add(ttl)}
+	}
+	close(call.done)
+}
+
+// Returns how long a result may be cached, and whether it may be cached at all
+func (c *Cache) ttl(response Response, err error) (ttl time.Duration, ok bool) {
+	switch {
+	case err == nil:
+		ttl = time.Duration(response.TTL) * time.Second
+	case errors.Is(err, ErrNXDOMAIN):
+		var seconds uint32
+		if seconds, ok = negativeTTL(err); !ok {
+			return
+		}
+		ttl = time.Duration(seconds) * time.Second
+	default:
+		return
+	}
+	if ttl < c.MinTTL {
+		ttl = c.MinTTL
+	}
+	if c.MaxTTL > 0 && ttl > c.MaxTTL {
+		ttl = c.MaxTTL
+	}
+	return ttl, ttl > 0
+}
+
+// Returns the negative caching TTL from the SOA records in NXDOMAIN answers,
+// the lower of the SOA's own TTL and its minimum field (RFC 2308 section 5)
+func negativeTTL(err error) (ttl uint32, ok bool) {
+	var lookupErr *LookupError
+	if !errors.As(err, &lookupErr) {
+		return
+	}
+	for _, nsErr := range lookupErr.Errors {
+		var rcodeErr *RcodeError
+		if !errors.As(nsErr, &rcodeErr) || rcodeErr.Rcode != dns.RcodeNameError || rcodeErr.Msg == nil {
+			continue
+		}
+		for _, rr := range rcodeErr.Msg.Ns {
+			soa, isSOA := rr.(*dns.SOA)
+			if !isSOA {
+				continue
+			}
+			soaTTL := min(soa.Hdr.Ttl, soa.Minttl)
+			if !ok || soaTTL < ttl {
+				ttl, ok = soaTTL, true
+			}
+		}
+	}
+	return
+}
+
+// Identifies the lookups that share cache entries: the domain, the
+// set of nameservers and every option that changes the result or how
+// far it can be trusted
+func cacheKey(req request) string {
+	endpoints := make([]string, 0, len(req.NameServers))
+	for _, nameserver := range req.NameServers {
+		endpoints = append(endpoints, nameserver.key()+"/"+tsigFingerprint(tsigKey(req, nameserver)))
+	}
+	sort.Strings(endpoints)
+	fields := []string{
+		strings.ToLower(dns.Fqdn(req.Domain)),
+		strings.Join(endpoints, ","),
+		strconv.FormatBool(req.ValidateDNSSEC),
+		strconv.FormatBool(req.StrictDuplicates),
+		strconv.FormatBool(req.EDNS0DO),
+		strconv.FormatBool(req.CheckSerial),
+		strconv.FormatBool(req.Authoritative),
+		strconv.Itoa(req.AuthoritativePort),
+		strings.Join(req.Search, ","),
+		strconv.Itoa(req.Ndots),
+	}
+	// Discovered nameservers replace NameServers, so the discovery identifies them
+	if req.Discovery != nil {
+		fields = append(fields, req.Discovery.key())
+	}
+	for _, option := range req.EDNS0Options {
+		fields = append(fields, strconv.Itoa(int(option.Option()))+"="+option.String())
+	}
+	for _, anchor := range req.TrustAnchors {
+		fields = append(fields, anchor.String())
+	}
+	return strings.Join(fields, " ")
+}
+
+// Identifies a TSIG key without including its secret
+func tsigFingerprint(key *TSIGKey) string {
+	if key == nil {
+		return ""
+	}
+	sum := sha256.Sum256([]byte(key.Secret))
+	return key.name() + ":" + key.algorithm() + ":" + hex.EncodeToString(sum[:8])
+}
+
+// Returns a copy that callers can modify without affecting the cache
+func (r Response) clone() Response {
+	if r.Config != nil {
+		config := make(map[string]string, len(r.Config))
+		for name, value := range r.Config {
+			config[name] = value
+		}
+		r.Config = config
+	}
+	r.Attributes = append([]Attribute(nil), r.Attributes...)
+	if r.Msg != nil {
+		r.Msg = r.Msg.Copy()
+	}
+	return r
+}
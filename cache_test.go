@@ -0,0 +1,482 @@
+package dta
+
+import (
+	"context"
+	"errors"
+	"net"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A clock for tests that only moves when told to
+type fakeClock struct {
+	mu  sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.now = c.now.Add(d)
+}
+
+// Wraps handler to count the queries it receives
+func countingHandler(count *atomic.Int32, handler dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		count.Add(1)
+		handler(w, r)
+	}
+}
+
+// Returns a handler answering with one TXT record with the given TTL
+func ttlHandler(ttl uint32, entry string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Answer = append(m.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: ttl},
+			Txt: []string{entry},
+		})
+		w.WriteMsg(m)
+	}
+}
+
+// Returns a handler answering NXDOMAIN, with an SOA in the authority section if soa is set
+func nxdomainHandler(soa *dns.SOA) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeNameError)
+		if soa != nil {
+			m.Ns = append(m.Ns, soa)
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func newTestCache(minTTL, maxTTL time.Duration) (*Cache, *fakeClock) {
+	clock := newFakeClock()
+	cache := NewCache(minTTL, maxTTL)
+	cache.now = clock.Now
+	return cache, clock
+}
+
+func TestCacheHonoursTTL(t *testing.T) {
+	var queries atomic.Int32
+	cache, clock := newTestCache(0, 0)
+	request := NewRequest("example.com", startServer(t, countingHandler(&queries, ttlHandler(60, "color=blue"))))
+	request.Cache = cache
+	for i := 0; i < 3; i++ {
+		res, err := request.Get()
+		if err != nil {
+			t.Fatalf("Unexpected error: %v", err)
+		}
+		if res.Config["color"] != "blue" {
+			t.Errorf("Expected color=blue, got %v", res.Config)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Expected 1 query, got %d", n)
+	}
+	clock.Advance(59 * time.Second)
+	request.Get()
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Expected entry to still be cached, got %d queries", n)
+	}
+	clock.Advance(time.Second)
+	request.Get()
+	if n := queries.Load(); n != 2 {
+		t.Errorf("Expected expired entry to be refreshed, got %d queries", n)
+	}
+}
+
+func TestCacheTTLClamps(t *testing.T) {
+	var queries atomic.Int32
+	cache, clock := newTestCache(0, 10*time.Second)
+	request := NewRequest("example.com", startServer(t, countingHandler(&queries, ttlHandler(3600, "color=blue"))))
+	request.Cache = cache
+	request.Get()
+	clock.Advance(10 * time.Second)
+	request.Get()
+	if n := queries.Load(); n != 2 {
+		t.Errorf("Expected MaxTTL to expire the entry, got %d queries", n)
+	}
+
+	queries.Store(0)
+	cache, clock = newTestCache(30*time.Second, 0)
+	request = NewRequest("example.com", startServer(t, countingHandler(&queries, ttlHandler(0, "color=blue"))))
+	request.Cache = cache
+	request.Get()
+	clock.Advance(29 * time.Second)
+	request.Get()
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Expected MinTTL to keep the entry, got %d queries", n)
+	}
+}
+
+func TestCacheSkipsZeroTTL(t *testing.T) {
+	var queries atomic.Int32
+	cache, _ := newTestCache(0, 0)
+	request := NewRequest("example.com", startServer(t, countingHandler(&queries, ttlHandler(0, "color=blue"))))
+	request.Cache = cache
+	request.Get()
+	request.Get()
+	if n := queries.Load(); n != 2 {
+		t.Errorf("Expected zero TTL answers not to be cached, got %d queries", n)
+	}
+}
+
+func TestCacheNegativeAnswers(t *testing.T) {
+	var queries atomic.Int32
+	soa := &dns.SOA{
+		Hdr:    dns.RR_Header{Name: "example.com.", Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 3600},
+		Ns:     "ns.example.com.",
+		Mbox:   "hostmaster.example.com.",
+		Minttl: 60,
+	}
+	cache, clock := newTestCache(0, 0)
+	request := NewRequest("missing.example.com", startServer(t, countingHandler(&queries, nxdomainHandler(soa))))
+	request.Cache = cache
+	for i := 0; i < 2; i++ {
+		if _, err := request.Get(); !errors.Is(err, ErrNXDOMAIN) {
+			t.Errorf("Expected cached NXDOMAIN, got: %v", err)
+		}
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Expected NXDOMAIN to be cached, got %d queries", n)
+	}
+	clock.Advance(time.Minute)
+	request.Get()
+	if n := queries.Load(); n != 2 {
+		t.Errorf("Expected NXDOMAIN to expire after the SOA minimum, got %d queries", n)
+	}
+}
+
+func TestCacheSkipsUncacheableErrors(t *testing.T) {
+	for name, handler := range map[string]dns.HandlerFunc{
+		"NXDOMAIN without SOA": nxdomainHandler(nil),
+		"SERVFAIL":             rcodeHandler(dns.RcodeServerFailure),
+	} {
+		var queries atomic.Int32
+		cache, _ := newTestCache(0, 0)
+		request := NewRequest("example.com", startServer(t, countingHandler(&queries, handler)))
+		request.Cache = cache
+		request.Get()
+		request.Get()
+		if n := queries.Load(); n != 2 {
+			t.Errorf("Expected %s not to be cached, got %d queries", name, n)
+		}
+	}
+}
+
+func TestCacheKeyedByDomainAndNameServers(t *testing.T) {
+	var queries atomic.Int32
+	cache, _ := newTestCache(0, 0)
+	nameserver1 := startServer(t, countingHandler(&queries, ttlHandler(60, "color=blue")))
+	nameserver2 := startServer(t, countingHandler(&queries, ttlHandler(60, "color=red")))
+	nameserver2.Priority = 1
+
+	for _, request := range []request{
+		NewRequest("example.com", nameserver1, nameserver2),
+		NewRequest("EXAMPLE.com.", nameserver2, nameserver1),
+	} {
+		request.Cache = cache
+		request.Get()
+	}
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Expected the same domain and nameserver set to share an entry, got %d queries", n)
+	}
+	for _, request := range []request{
+		NewRequest("other.example.com", nameserver1, nameserver2),
+		NewRequest("example.com", nameserver2),
+	} {
+		request.Cache = cache
+		request.Get()
+	}
+	if n := queries.Load(); n != 3 {
+		t.Errorf("Expected different domains and nameservers to have their own entries, got %d queries", n)
+	}
+}
+
+func TestCacheReturnsCopies(t *testing.T) {
+	cache, _ := newTestCache(0, 0)
+	request := NewRequest("example.com", startServer(t, ttlHandler(60, "color=blue")))
+	request.Cache = cache
+	res, _ := request.Get()
+	res.Config["color"] = "red"
+	res.Attributes[0].Value = "red"
+	res.Msg.Answer[0].(*dns.TXT).Txt[0] = "color=red"
+	res, _ = request.Get()
+	if res.Config["color"] != "blue" || res.Attributes[0].Value != "blue" || res.Msg.Answer[0].(*dns.TXT).Txt[0] != "color=blue" {
+		t.Errorf("Expected cached response to be unaffected, got %+v", res)
+	}
+}
+
+func TestCacheConcurrentLookups(t *testing.T) {
+	var queries atomic.Int32
+	handler := ttlHandler(60, "color=blue")
+	nameserver := startServer(t, countingHandler(&queries, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(50 * time.Millisecond)
+		handler(w, r)
+	}))
+	cache := NewCache(0, 0)
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			request := NewRequest("example.com", nameserver)
+			request.Cache = cache
+			res, err := request.Get()
+			if err != nil || res.Config["color"] != "blue" {
+				t.Errorf("Expected color=blue, got %v, %v", res.Config, err)
+			}
+		}()
+	}
+	wg.Wait()
+	if n := queries.Load(); n != 1 {
+		t.Errorf("Expected concurrent lookups to share one query, got %d", n)
+	}
+}
+
+func TestCacheWaiterCancelled(t *testing.T) {
+	handler := ttlHandler(60, "color=blue")
+	nameserver := startServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(100 * time.Millisecond)
+		handler(w, r)
+	})
+	request := NewRequest("example.com", nameserver)
+	request.Cache = NewCache(0, 0)
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := request.GetContext(ctx); !errors.Is(err, ErrDeadlineExceeded) {
+		t.Errorf("Expected ErrDeadlineExceeded, got: %v", err)
+	}
+	// The lookup carries on for later callers
+	res, err := request.Get()
+	if err != nil || res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue, got %v, %v", res.Config, err)
+	}
+}
+
+func TestCachePurge(t *testing.T) {
+	var queries atomic.Int32
+	request := NewRequest("example.com", startServer(t, countingHandler(&queries, ttlHandler(60, "color=blue"))))
+	request.Cache = NewCache(0, 0)
+	request.Get()
+	request.Cache.Purge()
+	request.Get()
+	if n := queries.Load(); n != 2 {
+		t.Errorf("Expected purge to drop entries, got %d queries", n)
+	}
+}
+
+// Returns a handler that answers with the current value of entry, or SERVFAIL while failing is set
+func switchableHandler(entry *atomic.Value, failing *atomic.Bool) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if failing.Load() {
+			rcodeHandler(dns.RcodeServerFailure)(w, r)
+			return
+		}
+		ttlHandler(60, entry.Load().(string))(w, r)
+	}
+}
+
+func TestCacheServeStale(t *testing.T) {
+	var entry atomic.Value
+	var failing atomic.Bool
+	entry.Store("color=blue")
+	cache, clock := newTestCache(0, 0)
+	cache.MaxStale = time.Hour
+	request := NewRequest("example.com", startServer(t, switchableHandler(&entry, &failing)))
+	request.Cache = cache
+	if res, err := request.Get(); err != nil || res.Stale {
+		t.Fatalf("Expected fresh response, got %+v, %v", res, err)
+	}
+
+	failing.Store(true)
+	clock.Advance(2 * time.Minute)
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Expected stale response instead of error, got: %v", err)
+	}
+	if !res.Stale || res.Config["color"] != "blue" {
+		t.Errorf("Expected stale color=blue, got %+v", res)
+	}
+
+	clock.Advance(time.Hour)
+	if _, err := request.Get(); !errors.Is(err, ErrSERVFAIL) {
+		t.Errorf("Expected error once past MaxStale, got: %v", err)
+	}
+}
+
+func TestCacheServeStaleRecovers(t *testing.T) {
+	var entry atomic.Value
+	var failing atomic.Bool
+	entry.Store("color=blue")
+	cache, clock := newTestCache(0, 0)
+	cache.MaxStale = time.Hour
+	request := NewRequest("example.com", startServer(t, switchableHandler(&entry, &failing)))
+	request.Cache = cache
+	request.Get()
+	clock.Advance(2 * time.Minute)
+	entry.Store("color=red")
+	res, err := request.Get()
+	if err != nil || res.Stale || res.Config["color"] != "red" {
+		t.Errorf("Expected fresh color=red once nameservers answer, got %+v, %v", res, err)
+	}
+}
+
+func TestCacheServeStaleNotForNXDOMAIN(t *testing.T) {
+	var nxdomain atomic.Bool
+	handler := ttlHandler(60, "color=blue")
+	cache, clock := newTestCache(0, 0)
+	cache.MaxStale = time.Hour
+	request := NewRequest("example.com", startServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if nxdomain.Load() {
+			nxdomainHandler(nil)(w, r)
+			return
+		}
+		handler(w, r)
+	}))
+	request.Cache = cache
+	request.Get()
+	nxdomain.Store(true)
+	clock.Advance(2 * time.Minute)
+	if _, err := request.Get(); !errors.Is(err, ErrNXDOMAIN) {
+		t.Errorf("Expected NXDOMAIN rather than stale data, got: %v", err)
+	}
+}
+
+func TestCacheServeStaleNotForStrictDuplicates(t *testing.T) {
+	var entries atomic.Value
+	entries.Store([]string{"color=blue"})
+	cache, clock := newTestCache(0, 0)
+	cache.MaxStale = time.Hour
+	request := NewRequest("example.com", startServer(t, entriesHandler(&entries)))
+	request.Cache = cache
+	request.StrictDuplicates = true
+	request.Get()
+	entries.Store([]string{"color=blue", "color=red"})
+	clock.Advance(10 * time.Minute)
+	if res, err := request.Get(); !errors.Is(err, ErrDuplicateAttribute) {
+		t.Errorf("Expected ErrDuplicateAttribute rather than stale data, got %+v, %v", res, err)
+	}
+}
+
+func TestCacheServeStaleDisabled(t *testing.T) {
+	var entry atomic.Value
+	var failing atomic.Bool
+	entry.Store("color=blue")
+	cache, clock := newTestCache(0, 0)
+	request := NewRequest("example.com", startServer(t, switchableHandler(&entry, &failing)))
+	request.Cache = cache
+	request.Get()
+	failing.Store(true)
+	clock.Advance(2 * time.Minute)
+	if _, err := request.Get(); !errors.Is(err, ErrSERVFAIL) {
+		t.Errorf("Expected error without MaxStale, got: %v", err)
+	}
+}
+
+func TestCacheStaleWhileRevalidate(t *testing.T) {
+	var entry atomic.Value
+	var failing atomic.Bool
+	entry.Store("color=blue")
+	cache, clock := newTestCache(0, 0)
+	cache.MaxStale = time.Hour
+	cache.StaleWhileRevalidate = true
+	request := NewRequest("example.com", startServer(t, switchableHandler(&entry, &failing)))
+	request.Cache = cache
+	request.Get()
+
+	entry.Store("color=red")
+	clock.Advance(2 * time.Minute)
+	res, err := request.Get()
+	if err != nil || !res.Stale || res.Config["color"] != "blue" {
+		t.Fatalf("Expected stale color=blue while revalidating, got %+v, %v", res, err)
+	}
+	// The background refresh replaces the entry
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		res, err = request.Get()
+		if err == nil && !res.Stale {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for background refresh, got %+v, %v", res, err)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if res.Config["color"] != "red" {
+		t.Errorf("Expected refreshed color=red, got %v", res.Config)
+	}
+}
+
+func TestCacheKeyedByTSIG(t *testing.T) {
+	var queries atomic.Int32
+	cache, _ := newTestCache(0, 0)
+	// Answers unsigned queries, leaving signed ones to fail verification
+	nameserver := startServer(t, countingHandler(&queries, ttlHandler(60, "color=blue")))
+	unsigned := NewRequest("example.com", nameserver)
+	unsigned.Cache = cache
+	if _, err := unsigned.Get(); err != nil {
+		t.Fatalf("Expected response, got: %v", err)
+	}
+	signed := NewRequest("example.com", nameserver)
+	signed.Cache = cache
+	signed.TSIG = testTSIGKey
+	if _, err := signed.Get(); !errors.Is(err, ErrTSIGUnsigned) {
+		t.Errorf("Expected the signed request not to share the unsigned entry, got: %v", err)
+	}
+	if n := queries.Load(); n != 2 {
+		t.Errorf("Expected a query for each request, got %d", n)
+	}
+}
+
+func TestCacheKeyedByOptions(t *testing.T) {
+	base := NewRequest("example.com", NameServer{Host: "192.0.2.1"})
+	subnet := func(address string) []dns.EDNS0 {
+		return []dns.EDNS0{&dns.EDNS0_SUBNET{Code: dns.EDNS0SUBNET, Family: 1, SourceNetmask: 24, Address: net.ParseIP(address).To4()}}
+	}
+	anchor, err := dns.NewRR(rootTrustAnchors[0])
+	if err != nil {
+		t.Fatalf("Failed to parse trust anchor: %v", err)
+	}
+	variants := map[string]func(*request){
+		"request TSIG":       func(r *request) { r.TSIG = testTSIGKey },
+		"nameserver TSIG":    func(r *request) { r.NameServers = []NameServer{{Host: "192.0.2.1", TSIG: testTSIGKey}} },
+		"TSIG secret":        func(r *request) { r.TSIG = &TSIGKey{Name: testTSIGKey.Name, Secret: "b3RoZXIgc2VjcmV0"} },
+		"client subnet":      func(r *request) { r.EDNS0Options = subnet("198.51.100.0") },
+		"DO bit":             func(r *request) { r.EDNS0DO = true },
+		"trust anchors":      func(r *request) { r.TrustAnchors = []*dns.DS{anchor.(*dns.DS)} },
+		"authoritative":      func(r *request) { r.Authoritative = true },
+		"authoritative port": func(r *request) { r.AuthoritativePort = 5353 },
+	}
+	for name, change := range variants {
+		variant := base
+		change(&variant)
+		if cacheKey(variant) == cacheKey(base) {
+			t.Errorf("Expected %s to change the cache key", name)
+		}
+	}
+	subnet1, subnet2 := base, base
+	subnet1.EDNS0Options = subnet("198.51.100.0")
+	subnet2.EDNS0Options = subnet("203.0.113.0")
+	if cacheKey(subnet1) == cacheKey(subnet2) {
+		t.Errorf("Expected different client subnets to have their own entries")
+	}
+}
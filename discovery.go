@@ -0,0 +1,150 @@
+package dta
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNoSRVRecords is returned when an SRV lookup finds no usable nameservers
+var ErrNoSRVRecords = errors.New("no SRV records in answer")
+
+// How often discovered nameservers are refreshed when following TTLs and there's no usable TTL
+const defaultDiscoveryInterval = 5 * time.Minute
+
+// SRVDiscovery finds nameservers from the SRV records published for a
+// service, such as _dns._udp.example.com. Requests with Discovery set use
+// the discovered nameservers once there are any. An SRVDiscovery is safe
+// for concurrent use and can be shared between requests.
+type SRVDiscovery struct {
+	// Name is the owner of the SRV records
+	Name string
+	// Template is copied for each nameserver found, so its Transport,
+	// TLSConfig and TSIG apply to them all
+	Template NameServer
+
+	// Request used to look up the SRV records
+	bootstrap request
+
+	mu          sync.Mutex
+	nameservers NameServers
+	ttl         uint32
+	lastErr     error
+}
+
+// NewSRVDiscovery returns a discovery for the SRV records at name, looked
+// up using the bootstrap nameservers
+func NewSRVDiscovery(name string, bootstrap ...NameServer) *SRVDiscovery {
+	return &SRVDiscovery{Name: name, bootstrap: NewRequest(name, bootstrap...)}
+}
+
+// Identifies the discovery by its name, bootstrap nameservers and template
+func (d *SRVDiscovery) key() string {
+	fields := []string{
+		"discovery",
+		strings.ToLower(dns.Fqdn(d.Name)),
+		d.Template.key() + "/" + tsigFingerprint(d.Template.TSIG),
+	}
+	for _, nameserver := range d.bootstrap.NameServers {
+		fields = append(fields, nameserver.key())
+	}
+	return strings.Join(fields, " ")
+}
+
+// NameServers returns the nameservers found by the last successful refresh
+func (d *SRVDiscovery) NameServers() NameServers {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return append(NameServers(nil), d.nameservers...)
+}
+
+// LastError returns the error from the last refresh, or nil if it
+// succeeded. Background refreshes started by Start only report errors here.
+func (d *SRVDiscovery) LastError() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	return d.lastErr
+}
+
+// Refresh looks up the SRV records, mapping their priority, weight, port
+// and target onto nameservers. The previous nameservers are kept if it fails.
+func (d *SRVDiscovery) Refresh(ctx context.Context) error {
+	err := d.refresh(ctx)
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.lastErr = err
+	return err
+}
+
+func (d *SRVDiscovery) refresh(ctx context.Context) error {
+	record, _, _, err := query(ctx, d.bootstrap, newQuery(d.bootstrap, d.Name, dns.TypeSRV))
+	if err != nil {
+		return err
+	}
+	var nameservers NameServers
+	var srvs []*dns.SRV
+	for _, rr := range record.Answer {
+		srv, ok := rr.(*dns.SRV)
+		// A target of "." means the service isn't available there (RFC 2782)
+		if !ok || srv.Target == "." {
+			continue
+		}
+		srvs = append(srvs, srv)
+		nameserver := d.Template
+		nameserver.Priority = int(srv.Priority)
+		nameserver.Weight = int(srv.Weight)
+		nameserver.Port = int(srv.Port)
+		nameserver.Host = strings.TrimSuffix(srv.Target, ".")
+		nameservers = append(nameservers, nameserver)
+	}
+	if len(nameservers) == 0 {
+		return ErrNoSRVRecords
+	}
+	sort.Stable(PrioritySorter(nameservers))
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	d.nameservers = nameservers
+	d.ttl = lowestTTL(srvs)
+	return nil
+}
+
+// Start refreshes the nameservers, then keeps refreshing them in the
+// background every interval, or when the SRV records' TTL expires if
+// interval is zero, until ctx is done. Only the first refresh's error is
+// returned, later ones are available from LastError.
+func (d *SRVDiscovery) Start(ctx context.Context, interval time.Duration) error {
+	if err := d.Refresh(ctx); err != nil {
+		return err
+	}
+	go func() {
+		for {
+			timer := time.NewTimer(d.interval(interval))
+			select {
+			case <-ctx.Done():
+				timer.Stop()
+				return
+			case <-timer.C:
+			}
+			d.Refresh(ctx)
+		}
+	}()
+	return nil
+}
+
+// Returns how long to wait before the next refresh
+func (d *SRVDiscovery) interval(interval time.Duration) time.Duration {
+	if interval > 0 {
+		return interval
+	}
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.ttl == 0 {
+		return defaultDiscoveryInterval
+	}
+	return time.Duration(d.ttl) * time.Second
+}
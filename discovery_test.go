@@ -0,0 +1,157 @@
+package dta
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Returns a handler answering SRV queries with the records currently in srvs
+func srvHandler(srvs *atomic.Value) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, srv := range srvs.Load().([]dns.SRV) {
+			srv.Hdr = dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeSRV, Class: dns.ClassINET, Ttl: 60}
+			m.Answer = append(m.Answer, &srv)
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestSRVDiscoveryRefresh(t *testing.T) {
+	var srvs atomic.Value
+	srvs.Store([]dns.SRV{
+		{Priority: 20, Weight: 5, Port: 5353, Target: "backup.example.com."},
+		{Priority: 10, Weight: 60, Port: 53, Target: "ns1.example.com."},
+		{Priority: 10, Weight: 40, Port: 53, Target: "ns2.example.com."},
+		{Priority: 30, Target: "."},
+	})
+	discovery := NewSRVDiscovery("_dns._udp.example.com", startServer(t, srvHandler(&srvs)))
+	discovery.Template = NameServer{Transport: TransportTLS}
+	if err := discovery.Refresh(context.Background()); err != nil {
+		t.Fatalf("Expected nameservers, got: %v", err)
+	}
+	expected := NameServers{
+		{Priority: 10, Weight: 60, Port: 53, Host: "ns1.example.com", Transport: TransportTLS},
+		{Priority: 10, Weight: 40, Port: 53, Host: "ns2.example.com", Transport: TransportTLS},
+		{Priority: 20, Weight: 5, Port: 5353, Host: "backup.example.com", Transport: TransportTLS},
+	}
+	got := discovery.NameServers()
+	if len(got) != len(expected) {
+		t.Fatalf("Expected %+v, got %+v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Errorf("Expected %+v, got %+v", expected[i], got[i])
+		}
+	}
+}
+
+func TestSRVDiscoveryKeepsPrevious(t *testing.T) {
+	var srvs atomic.Value
+	srvs.Store([]dns.SRV{{Priority: 10, Port: 53, Target: "ns1.example.com."}})
+	discovery := NewSRVDiscovery("_dns._udp.example.com", startServer(t, srvHandler(&srvs)))
+	if err := discovery.Refresh(context.Background()); err != nil {
+		t.Fatalf("Expected nameservers, got: %v", err)
+	}
+	srvs.Store([]dns.SRV{{Target: "."}})
+	if err := discovery.Refresh(context.Background()); !errors.Is(err, ErrNoSRVRecords) {
+		t.Errorf("Expected ErrNoSRVRecords, got: %v", err)
+	}
+	if got := discovery.NameServers(); len(got) != 1 || got[0].Host != "ns1.example.com" {
+		t.Errorf("Expected previous nameservers to be kept, got %+v", got)
+	}
+}
+
+func TestSRVDiscoveryLookup(t *testing.T) {
+	nameserver := startServer(t, txtHandler("color=blue"))
+	var srvs atomic.Value
+	srvs.Store([]dns.SRV{{Priority: 10, Port: uint16(nameserver.Port), Target: "127.0.0.1."}})
+	discovery := NewSRVDiscovery("_dns._udp.example.com", startServer(t, srvHandler(&srvs)))
+	if err := discovery.Refresh(context.Background()); err != nil {
+		t.Fatalf("Expected nameservers, got: %v", err)
+	}
+	request := NewRequest("example.com")
+	request.Discovery = discovery
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Expected response, got: %v", err)
+	}
+	if res.Config["color"] != "blue" || res.NameServer.Port != nameserver.Port {
+		t.Errorf("Expected color=blue from the discovered nameserver, got %v from %+v", res.Config, res.NameServer)
+	}
+}
+
+func TestSRVDiscoveryStart(t *testing.T) {
+	var srvs atomic.Value
+	srvs.Store([]dns.SRV{{Priority: 10, Port: 53, Target: "ns1.example.com."}})
+	discovery := NewSRVDiscovery("_dns._udp.example.com", startServer(t, srvHandler(&srvs)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := discovery.Start(ctx, 10*time.Millisecond); err != nil {
+		t.Fatalf("Expected nameservers, got: %v", err)
+	}
+	srvs.Store([]dns.SRV{{Priority: 10, Port: 53, Target: "ns2.example.com."}})
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		if got := discovery.NameServers(); got[0].Host == "ns2.example.com" {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for the nameservers to be refreshed")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSRVDiscoveryStartLastError(t *testing.T) {
+	var srvs atomic.Value
+	srvs.Store([]dns.SRV{{Priority: 10, Port: 53, Target: "ns1.example.com."}})
+	discovery := NewSRVDiscovery("_dns._udp.example.com", startServer(t, srvHandler(&srvs)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	if err := discovery.Start(ctx, 10*time.Millisecond); err != nil || discovery.LastError() != nil {
+		t.Fatalf("Expected nameservers, got: %v", err)
+	}
+	srvs.Store([]dns.SRV{{Target: "."}})
+	deadline := time.Now().Add(2 * time.Second)
+	for !errors.Is(discovery.LastError(), ErrNoSRVRecords) {
+		if time.Now().After(deadline) {
+			t.Fatalf("Timed out waiting for the background refresh error, got: %v", discovery.LastError())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got := discovery.NameServers(); len(got) != 1 || got[0].Host != "ns1.example.com" {
+		t.Errorf("Expected previous nameservers to be kept, got %+v", got)
+	}
+}
+
+func TestSRVDiscoveryCacheKey(t *testing.T) {
+	cache := NewCache(0, 0)
+	var colors []string
+	for _, color := range []string{"blue", "red"} {
+		nameserver := startServer(t, txtHandler("color="+color))
+		var srvs atomic.Value
+		srvs.Store([]dns.SRV{{Priority: 10, Port: uint16(nameserver.Port), Target: "127.0.0.1."}})
+		discovery := NewSRVDiscovery("_dns._udp.example.com", startServer(t, srvHandler(&srvs)))
+		if err := discovery.Refresh(context.Background()); err != nil {
+			t.Fatalf("Expected nameservers, got: %v", err)
+		}
+		request := NewRequest("example.com")
+		request.Discovery = discovery
+		request.Cache = cache
+		res, err := request.Get()
+		if err != nil {
+			t.Fatalf("Expected response, got: %v", err)
+		}
+		colors = append(colors, res.Config["color"])
+	}
+	if colors[0] != "blue" || colors[1] != "red" {
+		t.Errorf("Expected each discovery's own answer, got %v", colors)
+	}
+}
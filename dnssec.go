@@ -0,0 +1,222 @@
+package dta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// ErrDNSSECBogus is returned when signatures don't verify against the chain of trust
+	ErrDNSSECBogus = errors.New("DNSSEC validation failed")
+	// ErrDNSSECInsecure is returned when the answer or a zone on its chain is unsigned
+	ErrDNSSECInsecure = errors.New("DNSSEC signatures missing")
+)
+
+// Root zone key signing keys, used when a request has no TrustAnchors
+var rootTrustAnchors = []string{
+	". 172800 IN DS 20326 8 2 E06D44B80B8F1D39A95C0B0D7C65D08458E880409BBB683457104237C7F8EC8D",
+	". 172800 IN DS 38696 8 2 683D2D0ACB8C9B712A1948B27F741219298D0A450D612C483AF444A4C0FB2B16",
+}
+
+// Walks the chain of trust for a response, caching each zone's verified keys
+type validator struct {
+	ctx     context.Context
+	req     request
+	anchors []*dns.DS
+	keys    map[string][]*dns.DNSKEY
+	now     time.Time
+}
+
+// Verifies every RRset in the answer section of record
+func validateAnswer(ctx context.Context, req request, record *dns.Msg) error {
+	anchors := req.TrustAnchors
+	if len(anchors) == 0 {
+		for _, s := range rootTrustAnchors {
+			rr, _ := dns.NewRR(s)
+			anchors = append(anchors, rr.(*dns.DS))
+		}
+	}
+	v := &validator{ctx: ctx, req: req, anchors: anchors, keys: make(map[string][]*dns.DNSKEY), now: time.Now()}
+	rrsets, sigs := splitRRsets(record.Answer)
+	if len(rrsets) == 0 {
+		return fmt.Errorf("%w: no answer to validate", ErrDNSSECInsecure)
+	}
+	for key, rrset := range rrsets {
+		if err := v.verifyRRset(rrset, sigs[key]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Groups records by owner and type, separating out the signatures covering each group
+func splitRRsets(rrs []dns.RR) (rrsets map[string][]dns.RR, sigs map[string][]*dns.RRSIG) {
+	rrsets = make(map[string][]dns.RR)
+	sigs = make(map[string][]*dns.RRSIG)
+	for _, rr := range rrs {
+		if sig, ok := rr.(*dns.RRSIG); ok {
+			key := rrsetKey(sig.Hdr.Name, sig.TypeCovered)
+			sigs[key] = append(sigs[key], sig)
+			continue
+		}
+		key := rrsetKey(rr.Header().Name, rr.Header().Rrtype)
+		rrsets[key] = append(rrsets[key], rr)
+	}
+	return
+}
+
+func rrsetKey(name string, rrtype uint16) string {
+	return strings.ToLower(dns.Fqdn(name)) + "/" + dns.TypeToString[rrtype]
+}
+
+// Checks that at least one signature over rrset verifies with a trusted key
+func (v *validator) verifyRRset(rrset []dns.RR, sigs []*dns.RRSIG) error {
+	owner := rrset[0].Header().Name
+	rrtype := dns.TypeToString[rrset[0].Header().Rrtype]
+	if len(sigs) == 0 {
+		return fmt.Errorf("%w: %s %s is unsigned", ErrDNSSECInsecure, owner, rrtype)
+	}
+	var lastErr error
+	for _, sig := range sigs {
+		if !dns.IsSubDomain(sig.SignerName, owner) {
+			lastErr = fmt.Errorf("%w: %s %s signed by unrelated zone %s", ErrDNSSECBogus, owner, rrtype, sig.SignerName)
+			continue
+		}
+		keys, err := v.zoneKeys(sig.SignerName)
+		if err != nil {
+			return err
+		}
+		if lastErr = v.verifySig(sig, keys, rrset); lastErr == nil {
+			return nil
+		}
+	}
+	return lastErr
+}
+
+// Verifies sig over rrset with whichever of keys it was made by
+func (v *validator) verifySig(sig *dns.RRSIG, keys []*dns.DNSKEY, rrset []dns.RR) error {
+	owner := rrset[0].Header().Name
+	rrtype := dns.TypeToString[rrset[0].Header().Rrtype]
+	if !sig.ValidityPeriod(v.now) {
+		return fmt.Errorf("%w: signature over %s %s is outside its validity period", ErrDNSSECBogus, owner, rrtype)
+	}
+	for _, key := range keys {
+		if key.KeyTag() != sig.KeyTag || key.Algorithm != sig.Algorithm {
+			continue
+		}
+		if sig.Verify(key, rrset) == nil {
+			return nil
+		}
+	}
+	return fmt.Errorf("%w: no valid signature over %s %s", ErrDNSSECBogus, owner, rrtype)
+}
+
+// Returns the authenticated DNSKEY RRset for zone, following DS
+// records up through parent zones until a trust anchor is reached
+func (v *validator) zoneKeys(zone string) ([]*dns.DNSKEY, error) {
+	zone = strings.ToLower(dns.Fqdn(zone))
+	if keys, ok := v.keys[zone]; ok {
+		return keys, nil
+	}
+	dsSet, err := v.trustedDS(zone)
+	if err != nil {
+		return nil, err
+	}
+
+	record, _, _, err := query(v.ctx, v.req, newQuery(v.req, zone, dns.TypeDNSKEY))
+	if err != nil {
+		return nil, err
+	}
+	var keys []*dns.DNSKEY
+	var keySet []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range record.Answer {
+		switch rr := rr.(type) {
+		case *dns.DNSKEY:
+			keys = append(keys, rr)
+			keySet = append(keySet, rr)
+		case *dns.RRSIG:
+			if rr.TypeCovered == dns.TypeDNSKEY {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	if len(keys) == 0 {
+		return nil, fmt.Errorf("%w: no DNSKEY records for %s", ErrDNSSECInsecure, zone)
+	}
+
+	// The key set has to be signed by a key matching one of the trusted DS records
+	var secureEntryPoints []*dns.DNSKEY
+	for _, key := range keys {
+		for _, ds := range dsSet {
+			if key.KeyTag() != ds.KeyTag || key.Algorithm != ds.Algorithm {
+				continue
+			}
+			if digest := key.ToDS(ds.DigestType); digest != nil && strings.EqualFold(digest.Digest, ds.Digest) {
+				secureEntryPoints = append(secureEntryPoints, key)
+			}
+		}
+	}
+	if len(secureEntryPoints) == 0 {
+		return nil, fmt.Errorf("%w: no DNSKEY for %s matches its DS records", ErrDNSSECBogus, zone)
+	}
+	verified := false
+	for _, sig := range sigs {
+		if strings.EqualFold(sig.SignerName, zone) && v.verifySig(sig, secureEntryPoints, keySet) == nil {
+			verified = true
+			break
+		}
+	}
+	if !verified {
+		return nil, fmt.Errorf("%w: DNSKEY set for %s isn't signed by a trusted key", ErrDNSSECBogus, zone)
+	}
+	v.keys[zone] = keys
+	return keys, nil
+}
+
+// Returns the DS records for zone, either from the trust anchors
+// or authenticated by the parent zone's keys
+func (v *validator) trustedDS(zone string) (dsSet []*dns.DS, err error) {
+	for _, anchor := range v.anchors {
+		if strings.EqualFold(dns.Fqdn(anchor.Hdr.Name), zone) {
+			dsSet = append(dsSet, anchor)
+		}
+	}
+	if len(dsSet) > 0 {
+		return
+	}
+	if zone == "." {
+		return nil, fmt.Errorf("%w: no trust anchor for the root zone", ErrDNSSECBogus)
+	}
+
+	record, _, _, err := query(v.ctx, v.req, newQuery(v.req, zone, dns.TypeDS))
+	if err != nil {
+		return
+	}
+	var rrset []dns.RR
+	var sigs []*dns.RRSIG
+	for _, rr := range record.Answer {
+		switch rr := rr.(type) {
+		case *dns.DS:
+			if strings.EqualFold(rr.Hdr.Name, zone) {
+				dsSet = append(dsSet, rr)
+				rrset = append(rrset, rr)
+			}
+		case *dns.RRSIG:
+			// DS records are signed by the parent, so anything else can't be part of the chain
+			if rr.TypeCovered == dns.TypeDS && dns.IsSubDomain(rr.SignerName, zone) && !strings.EqualFold(rr.SignerName, zone) {
+				sigs = append(sigs, rr)
+			}
+		}
+	}
+	if len(dsSet) == 0 {
+		return nil, fmt.Errorf("%w: no DS records for %s", ErrDNSSECInsecure, zone)
+	}
+	err = v.verifyRRset(rrset, sigs)
+	return
+}
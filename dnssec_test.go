@@ -0,0 +1,212 @@
+package dta
+
+import (
+	"crypto"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// A zone with a single combined signing key
+type testZone struct {
+	name string
+	key  *dns.DNSKEY
+	priv crypto.Signer
+}
+
+func newTestZone(t *testing.T, name string) *testZone {
+	t.Helper()
+	key := &dns.DNSKEY{
+		Hdr:       dns.RR_Header{Name: name, Rrtype: dns.TypeDNSKEY, Class: dns.ClassINET, Ttl: 3600},
+		Flags:     257,
+		Protocol:  3,
+		Algorithm: dns.ECDSAP256SHA256,
+	}
+	priv, err := key.Generate(256)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	return &testZone{name: name, key: key, priv: priv.(crypto.Signer)}
+}
+
+func (z *testZone) ds() *dns.DS {
+	return z.key.ToDS(dns.SHA256)
+}
+
+// Signs rrset with the zone's key, valid from inception to expiration
+func (z *testZone) sign(t *testing.T, rrset []dns.RR, inception, expiration time.Time) *dns.RRSIG {
+	t.Helper()
+	sig := &dns.RRSIG{
+		Hdr:        dns.RR_Header{Name: rrset[0].Header().Name, Rrtype: dns.TypeRRSIG, Class: dns.ClassINET, Ttl: rrset[0].Header().Ttl},
+		Algorithm:  z.key.Algorithm,
+		KeyTag:     z.key.KeyTag(),
+		SignerName: z.name,
+		Inception:  uint32(inception.Unix()),
+		Expiration: uint32(expiration.Unix()),
+	}
+	if err := sig.Sign(z.priv, rrset); err != nil {
+		t.Fatalf("Failed to sign: %v", err)
+	}
+	return sig
+}
+
+// Signed records for test.example. delegated from a test root zone
+type dnssecFixture struct {
+	root    *testZone
+	example *testZone
+	records map[string][]dns.RR
+}
+
+func newDNSSECFixture(t *testing.T) *dnssecFixture {
+	t.Helper()
+	f := &dnssecFixture{
+		root:    newTestZone(t, "."),
+		example: newTestZone(t, "example."),
+		records: make(map[string][]dns.RR),
+	}
+	f.add(t, f.root, f.root.key)
+	f.add(t, f.root, f.example.ds())
+	f.add(t, f.example, f.example.key)
+	f.add(t, f.example, &dns.TXT{
+		Hdr: dns.RR_Header{Name: "test.example.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+		Txt: []string{"color=blue"},
+	})
+	return f
+}
+
+// Adds rr and a currently valid signature over it by zone
+func (f *dnssecFixture) add(t *testing.T, zone *testZone, rr dns.RR) {
+	t.Helper()
+	key := rrsetKey(rr.Header().Name, rr.Header().Rrtype)
+	f.records[key] = []dns.RR{rr, zone.sign(t, []dns.RR{rr}, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))}
+}
+
+func (f *dnssecFixture) handler(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	m.SetReply(r)
+	m.Answer = f.records[rrsetKey(r.Question[0].Name, r.Question[0].Qtype)]
+	w.WriteMsg(m)
+}
+
+func (f *dnssecFixture) request(t *testing.T) request {
+	request := NewRequest("test.example", startServer(t, f.handler))
+	request.ValidateDNSSEC = true
+	request.TrustAnchors = []*dns.DS{f.root.ds()}
+	return request
+}
+
+func TestDNSSECValidAnswer(t *testing.T) {
+	f := newDNSSECFixture(t)
+	res, err := f.request(t).Get()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if !res.Secure {
+		t.Errorf("Expected response to be marked secure")
+	}
+	if res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue, got %v", res.Config)
+	}
+}
+
+func TestDNSSECQueryFlags(t *testing.T) {
+	f := newDNSSECFixture(t)
+	m := newQuery(f.request(t), "test.example", dns.TypeTXT)
+	if opt := m.IsEdns0(); opt == nil || !opt.Do() {
+		t.Errorf("Expected DO bit to be set when validating")
+	}
+	if !m.CheckingDisabled {
+		t.Errorf("Expected CD bit to be set when validating")
+	}
+}
+
+func TestDNSSECTamperedAnswer(t *testing.T) {
+	f := newDNSSECFixture(t)
+	key := rrsetKey("test.example.", dns.TypeTXT)
+	f.records[key][0].(*dns.TXT).Txt = []string{"color=red"}
+	res, err := f.request(t).Get()
+	if !errors.Is(err, ErrDNSSECBogus) {
+		t.Errorf("Expected ErrDNSSECBogus, got: %v", err)
+	}
+	if res.Secure || len(res.Config) != 0 {
+		t.Errorf("Expected no config from a bogus answer, got %+v", res)
+	}
+}
+
+func TestDNSSECUnsignedAnswer(t *testing.T) {
+	f := newDNSSECFixture(t)
+	key := rrsetKey("test.example.", dns.TypeTXT)
+	f.records[key] = f.records[key][:1]
+	_, err := f.request(t).Get()
+	if !errors.Is(err, ErrDNSSECInsecure) {
+		t.Errorf("Expected ErrDNSSECInsecure, got: %v", err)
+	}
+}
+
+func TestDNSSECMissingDelegation(t *testing.T) {
+	f := newDNSSECFixture(t)
+	delete(f.records, rrsetKey("example.", dns.TypeDS))
+	_, err := f.request(t).Get()
+	if !errors.Is(err, ErrDNSSECInsecure) {
+		t.Errorf("Expected ErrDNSSECInsecure, got: %v", err)
+	}
+}
+
+func TestDNSSECExpiredSignature(t *testing.T) {
+	f := newDNSSECFixture(t)
+	key := rrsetKey("test.example.", dns.TypeTXT)
+	txt := f.records[key][0]
+	f.records[key] = []dns.RR{txt, f.example.sign(t, []dns.RR{txt}, time.Now().Add(-2*time.Hour), time.Now().Add(-time.Hour))}
+	_, err := f.request(t).Get()
+	if !errors.Is(err, ErrDNSSECBogus) {
+		t.Errorf("Expected ErrDNSSECBogus, got: %v", err)
+	}
+}
+
+func TestDNSSECUntrustedRoot(t *testing.T) {
+	f := newDNSSECFixture(t)
+	request := f.request(t)
+	request.TrustAnchors = []*dns.DS{newTestZone(t, ".").ds()}
+	_, err := request.Get()
+	if !errors.Is(err, ErrDNSSECBogus) {
+		t.Errorf("Expected ErrDNSSECBogus, got: %v", err)
+	}
+}
+
+func TestDNSSECDelegationSignedByChild(t *testing.T) {
+	f := newDNSSECFixture(t)
+	// A zone can't vouch for its own DS records
+	ds := f.example.ds()
+	f.records[rrsetKey("example.", dns.TypeDS)] = []dns.RR{ds, f.example.sign(t, []dns.RR{ds}, time.Now().Add(-time.Hour), time.Now().Add(time.Hour))}
+	_, err := f.request(t).Get()
+	if err == nil {
+		t.Errorf("Expected error for self-signed delegation")
+	}
+}
+
+func TestDNSSECDisabled(t *testing.T) {
+	f := newDNSSECFixture(t)
+	request := f.request(t)
+	request.ValidateDNSSEC = false
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if res.Secure {
+		t.Errorf("Expected response not to be marked secure without validation")
+	}
+}
+
+func TestDefaultTrustAnchors(t *testing.T) {
+	for _, s := range rootTrustAnchors {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("Failed to parse trust anchor %q: %v", s, err)
+		}
+		if _, ok := rr.(*dns.DS); !ok {
+			t.Errorf("Expected DS record, got %T", rr)
+		}
+	}
+}
@@ -1,23 +1,53 @@
 package dta
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"net"
+	"math/rand/v2"
+	"net/http"
 	"sort"
-	"strconv"
 	"strings"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
 const (
-	txtString = "TXT"
+	// Default time to wait for a single nameserver to answer
+	defaultTimeout = 2 * time.Second
+	// Buffer size advertised when EDNS0 options are set without a size
+	defaultEDNS0BufferSize = 1232
 )
 
+// ErrDeadlineExceeded is returned when the overall lookup budget
+// expires before any nameserver returned an answer
+var ErrDeadlineExceeded = errors.New("lookup deadline exceeded")
+
 type NameServer struct {
 	Priority int
-	Host     string
-	Port     int
+	// Weight shares queries between nameservers of the same priority in
+	// proportion to their weights, as with SRV records (RFC 2782).
+	// Nameservers without a weight are tried after those with one.
+	Weight int
+	Host   string
+	// Port defaults to the standard port for the Transport if zero
+	Port int
+	// Transport selects how queries are sent to this nameserver
+	Transport Transport
+	// TLSConfig is used by TransportTLS and TransportHTTPS
+	TLSConfig *tls.Config
+	// URL is the TransportHTTPS endpoint, defaulting to https://Host:Port/dns-query
+	URL string
+	// HTTPMethod is GET or POST for TransportHTTPS, defaulting to POST
+	HTTPMethod string
+	// HTTPClient is used by TransportHTTPS. Without it nameservers share a
+	// default client, unless TLSConfig is set when a client is built for
+	// each query. Set it with TLSConfig to reuse connections between queries.
+	HTTPClient *http.Client
+	// TSIG signs queries to this nameserver, overriding the request's key
+	TSIG *TSIGKey
 }
 
 type NameServers []NameServer
@@ -25,10 +55,100 @@ type NameServers []NameServer
 type request struct {
 	Domain      string
 	NameServers []NameServer
+	// Timeout bounds the query to each individual nameserver
+	Timeout time.Duration
+	// TotalTimeout bounds the whole lookup across all nameservers
+	TotalTimeout time.Duration
+	// ForceTCP sends queries over TCP instead of starting with UDP
+	ForceTCP bool
+	// EDNS0BufferSize is the UDP payload size advertised in the OPT record.
+	// EDNS0 is only used if this or one of the other EDNS0 fields is set.
+	EDNS0BufferSize uint16
+	// EDNS0DO sets the DNSSEC OK bit
+	EDNS0DO bool
+	// EDNS0Options are added to the OPT record, e.g. *dns.EDNS0_SUBNET or *dns.EDNS0_COOKIE
+	EDNS0Options []dns.EDNS0
+	// ValidateDNSSEC rejects answers that can't be authenticated from TrustAnchors
+	ValidateDNSSEC bool
+	// TrustAnchors terminate the chain of trust, defaulting to the root zone's KSKs
+	TrustAnchors []*dns.DS
+	// TSIG signs queries and verifies the signature on answers
+	TSIG *TSIGKey
+	// StrictDuplicates fails lookups where an attribute name, ignoring
+	// case, appears more than once
+	StrictDuplicates bool
+	// Cache, if set, answers repeated lookups until the records expire
+	Cache *Cache
+	// Snapshots, if set, saves successful responses to disk and
+	// serves them when a lookup fails
+	Snapshots *SnapshotStore
+	// Debounce is how long Watch waits for changed attributes to
+	// settle before sending the changes
+	Debounce time.Duration
+	// HedgeDelay, if set, sends the query to the next nameserver whenever
+	// the previous ones haven't answered within the delay, using the first
+	// successful answer instead of waiting for each to fail in turn
+	HedgeDelay time.Duration
+	// Health, if set, records how each nameserver answers and tries
+	// the healthiest first within each priority
+	Health *HealthTracker
+	// Rand is the source for choosing between weighted nameservers,
+	// defaulting to the global source. A *rand.Rand isn't safe for
+	// concurrent use so it mustn't be shared between goroutines.
+	Rand *rand.Rand
+	// Attempts is how many times each nameserver is tried while they're
+	// timing out or unreachable, defaulting to once
+	Attempts int
+	// Search lists domains appended to Domain when it has fewer than
+	// Ndots dots, as with the search option in resolv.conf
+	Search []string
+	Ndots  int
+	// Discovery, if set, replaces NameServers with the nameservers it has found
+	Discovery *SRVDiscovery
+	// Authoritative queries the zone's authoritative nameservers directly,
+	// without recursion, to avoid resolver caches. NameServers are only
+	// used to find them and answers must have the AA bit set.
+	Authoritative bool
+	// AuthoritativePort is the port the authoritative nameservers are queried on, defaulting to 53
+	AuthoritativePort int
+	// CheckSerial looks up the zone's SOA serial with the TXT records so
+	// Refresh and Watch only fetch them again once the serial changes
+	CheckSerial bool
+
+	// Set on requests sent straight to authoritative nameservers
+	direct bool
 }
 
 type Response struct {
+	// Config maps each attribute name to its value. If a name
+	// has several values the first in Attributes order is used.
 	Config map[string]string
+	// Attributes holds every attribute in the answer, including duplicates,
+	// ordered by name ignoring case, then by name and value
+	Attributes []Attribute
+	// Secure is set when the answer passed DNSSEC validation
+	Secure bool
+	// NameServer is the nameserver that gave the answer
+	NameServer NameServer
+	// RTT is how long NameServer took to answer
+	RTT time.Duration
+	// Fetched is when the answer was received
+	Fetched time.Time
+	// TTL is the lowest TTL, in seconds, of the records the attributes came from
+	TTL uint32
+	// Serial is the zone's SOA serial, set when CheckSerial is
+	Serial uint32
+	// Authoritative, AuthenticatedData and RecursionAvailable are the AA, AD and RA header flags
+	Authoritative      bool
+	AuthenticatedData  bool
+	RecursionAvailable bool
+	// Rcode is the response code of the answer
+	Rcode int
+	// Msg is the answer as received
+	Msg *dns.Msg
+	// Stale is set when an expired cached response or a snapshot
+	// is served because the nameservers failed or it's being refreshed
+	Stale bool
 }
 
 type PrioritySorter []NameServer
@@ -40,97 +160,347 @@ func (a PrioritySorter) Less(i, j int) bool { return a[i].Priority < a[j].Priori
 func NewRequest(domain string, ns ...NameServer) (req request) {
 	// Sort nameservers by priority
 	sort.Sort(PrioritySorter(ns))
-	req = request{domain, ns}
+	req = request{Domain: domain, NameServers: ns}
 	return
 }
 
-func getTxtRecord(domain string, nameservers ...NameServer) (txtRecord *dns.Msg, err error) {
-	c := new(dns.Client)
-	m := new(dns.Msg)
-	m.SetQuestion(dns.Fqdn(domain), dns.TypeTXT)
-	m.RecursionDesired = true
-	nameserverCount := len(nameservers)
-	for i, nameserver := range nameservers {
-		record, _, exchangeErr := c.Exchange(m, net.JoinHostPort(nameserver.Host, strconv.Itoa(nameserver.Port)))
+func getTxtRecord(ctx context.Context, req request) (txtRecord *dns.Msg, answeredBy NameServer, rtt time.Duration, err error) {
+	return query(ctx, req, newQuery(req, req.Domain, dns.TypeTXT))
+}
+
+// Sends m to each nameserver in turn until one answers successfully,
+// returning the answer with the nameserver that gave it and how long it
+// took. The nameservers are tried again, up to Attempts times in all,
+// while some aren't answering.
+func query(ctx context.Context, req request, m *dns.Msg) (answer *dns.Msg, answeredBy NameServer, rtt time.Duration, err error) {
+	var failures []*NameServerError
+	for attempt := 1; ; attempt++ {
+		answer, answeredBy, rtt, err = queryNameServers(ctx, req, m)
+		lookupErr, ok := err.(*LookupError)
+		if !ok {
+			return
+		}
+		retry := attempt < req.Attempts && lookupErr.Err == nil && unanswered(lookupErr.Errors)
+		lookupErr.Errors = append(failures, lookupErr.Errors...)
+		if !retry {
+			return
+		}
+		failures = lookupErr.Errors
+	}
+}
+
+// Reports whether any of the nameservers failed to give an answer, as
+// opposed to answering with an unsuccessful rcode
+func unanswered(failures []*NameServerError) bool {
+	for _, failure := range failures {
+		var rcodeErr *RcodeError
+		if !errors.As(failure, &rcodeErr) {
+			return true
+		}
+	}
+	return false
+}
+
+// Tries each nameserver once
+func queryNameServers(ctx context.Context, req request, m *dns.Msg) (answer *dns.Msg, answeredBy NameServer, rtt time.Duration, err error) {
+	if req.Discovery != nil {
+		if discovered := req.Discovery.NameServers(); len(discovered) > 0 {
+			req.NameServers = discovered
+		}
+	}
+	req.NameServers = weightedOrder(req.NameServers, req.Rand)
+	if req.Health != nil {
+		req.NameServers = req.Health.order(req.NameServers)
+	}
+	if req.HedgeDelay > 0 && len(req.NameServers) > 1 {
+		return hedgedQuery(ctx, req, m)
+	}
+	lookupErr := &LookupError{Domain: m.Question[0].Name}
+	for _, nameserver := range req.NameServers {
+		// Stop trying further nameservers once the overall budget is spent
+		if contextDone(ctx) {
+			lookupErr.Err = contextError(ctx)
+			return nil, answeredBy, 0, lookupErr
+		}
+		start := time.Now()
+		record, exchangeErr := exchange(ctx, req, m, nameserver)
+		req.Health.record(ctx, nameserver, record, exchangeErr, time.Since(start))
 		// If there was a DNS error
 		if exchangeErr != nil {
-			// and we're out of name servers to try, return the error
-			if i+1 >= nameserverCount {
-				err = fmt.Errorf("%s", exchangeErr)
-				return
-			} else {
-				continue
+			lookupErr.Errors = append(lookupErr.Errors, &NameServerError{NameServer: nameserver, Err: classifyError(exchangeErr)})
+			if contextDone(ctx) {
+				lookupErr.Err = contextError(ctx)
+				return nil, answeredBy, 0, lookupErr
 			}
+			continue
 		}
 
 		// If there was a record error
 		if record.Rcode != dns.RcodeSuccess {
-			// and we're out of name servers to try, return the error
-			if i+1 >= nameserverCount {
-				err = fmt.Errorf("%s", dns.RcodeToString[record.Rcode])
-				return
-			} else {
-				continue
-			}
-		} else {
-			return record, err
+			lookupErr.Errors = append(lookupErr.Errors, &NameServerError{NameServer: nameserver, Err: &RcodeError{Rcode: record.Rcode, Msg: record}})
+			continue
 		}
+		return record, nameserver, time.Since(start), nil
 	}
-	return
+	return nil, answeredBy, 0, lookupErr
 }
 
-// Extracts the attribute name and
-// returns it with the start position of the value
-func getAttribute(s string) (a string, valueStart int) {
-	// Find first equals sign not preceded by `
-	var attributeEnd int
-	for i, c := range s {
-		if c == '=' {
-			if s[i-1] == '`' {
-				continue
-			} else {
-				attributeEnd = i
-				valueStart = i + 1
-				break
-			}
+// Builds a query for name and qtype with the request's EDNS0 settings
+func newQuery(req request, name string, qtype uint16) (m *dns.Msg) {
+	m = new(dns.Msg)
+	m.SetQuestion(dns.Fqdn(name), qtype)
+	m.RecursionDesired = !req.direct
+	// Validation needs signatures even for data the resolver considers bogus
+	m.CheckingDisabled = req.ValidateDNSSEC
+	if req.EDNS0BufferSize > 0 || req.EDNS0DO || len(req.EDNS0Options) > 0 || req.ValidateDNSSEC {
+		size := req.EDNS0BufferSize
+		if size == 0 {
+			size = defaultEDNS0BufferSize
 		}
+		m.SetEdns0(size, req.EDNS0DO || req.ValidateDNSSEC)
+		opt := m.IsEdns0()
+		opt.Option = append(opt.Option, req.EDNS0Options...)
 	}
-	a = s[1:attributeEnd]
-	a = strings.Replace(a, "`=", "=", -1)
-	a = strings.Replace(a, "` ", " ", -1)
-	a = strings.Replace(a, "\\\\", "\\", -1)
 	return
 }
 
-// Process quoted values in the extracted value string
-func processValue(rawVal string) (processedVal string) {
-	// Replace double backticks with single
-	processedVal = strings.Replace(rawVal, "``", "`", -1)
-	processedVal = strings.Replace(rawVal, "\\\\", "\\", -1)
-	return
+// Reports whether ctx is cancelled or past its deadline. The deadline is
+// checked directly as connection deadlines can fire before ctx.Err is set.
+func contextDone(ctx context.Context) bool {
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return true
+	}
+	return ctx.Err() != nil
+}
+
+// Converts a finished context into the error returned to callers,
+// keeping the context's own error in the chain
+func contextError(ctx context.Context) error {
+	if deadline, ok := ctx.Deadline(); ok && !time.Now().Before(deadline) {
+		return fmt.Errorf("%w: %w", ErrDeadlineExceeded, context.DeadlineExceeded)
+	}
+	return ctx.Err()
 }
 
 // Extract each TXT entry and return a map of the kv pairs
 func processRecord(txtRecord *dns.Msg) (response Response) {
 	var config map[string]string
 	config = make(map[string]string)
-	for _, a := range txtRecord.Answer {
-		rawLine := strings.TrimSpace(a.String()[strings.LastIndex(a.String(), txtString)+len(txtString):])
-		// Check '=' exists and isn't first char
-		if strings.Index(rawLine, "=") <= 1 {
+	var attributes []Attribute
+	txts, ttl := txtAnswers(txtRecord)
+	for _, txt := range txts {
+		// Entries that aren't attributes are ignored
+		attribute, err := Parse(txtValue(txt))
+		if err != nil {
 			continue
 		}
-		attributeName, valueStart := getAttribute(rawLine)
-		config[attributeName] = processValue(rawLine[valueStart : len(rawLine)-1])
+		attribute.TTL = txt.Hdr.Ttl
+		attributes = append(attributes, attribute)
+	}
+	// RRset order isn't stable between answers, so impose one
+	sort.Slice(attributes, func(i, j int) bool { return attributeLess(attributes[i], attributes[j]) })
+	for _, attribute := range attributes {
+		if _, ok := config[attribute.Name]; !ok {
+			config[attribute.Name] = attribute.Value
+		}
 	}
 	response.Config = config
+	response.Attributes = attributes
+	response.TTL = ttl
+	response.Authoritative = txtRecord.Authoritative
+	response.AuthenticatedData = txtRecord.AuthenticatedData
+	response.RecursionAvailable = txtRecord.RecursionAvailable
+	response.Rcode = txtRecord.Rcode
+	response.Msg = txtRecord
+	return
+}
+
+// Joins the character-strings of a TXT record into one, undoing
+// the escaping of quotes, backslashes and unprintable bytes
+// applied by the dns package
+func txtValue(txt *dns.TXT) string {
+	var b strings.Builder
+	for _, s := range txt.Txt {
+		for i := 0; i < len(s); i++ {
+			if s[i] == '\\' && i+1 < len(s) {
+				if i+3 < len(s) && isDigit(s[i+1]) && isDigit(s[i+2]) && isDigit(s[i+3]) {
+					b.WriteByte((s[i+1]-'0')*100 + (s[i+2]-'0')*10 + (s[i+3] - '0'))
+					i += 3
+					continue
+				}
+				i++
+			}
+			b.WriteByte(s[i])
+		}
+	}
+	return b.String()
+}
+
+func isDigit(c byte) bool {
+	return c >= '0' && c <= '9'
+}
+
+// Returns the TXT records owned by the queried name, following
+// any CNAME chain in the answer and ignoring other record types,
+// along with the lowest TTL of the records used
+func txtAnswers(msg *dns.Msg) (txts []*dns.TXT, minTTL uint32) {
+	if len(msg.Question) == 0 {
+		for _, rr := range msg.Answer {
+			if txt, ok := rr.(*dns.TXT); ok {
+				txts = append(txts, txt)
+			}
+		}
+		return txts, lowestTTL(txts)
+	}
+	names := map[string]bool{strings.ToLower(msg.Question[0].Name): true}
+	var chain []*dns.CNAME
+	// Each pass can only extend the chain by one link
+	for range msg.Answer {
+		extended := false
+		for _, rr := range msg.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && names[strings.ToLower(cname.Hdr.Name)] && !names[strings.ToLower(cname.Target)] {
+				names[strings.ToLower(cname.Target)] = true
+				chain = append(chain, cname)
+				extended = true
+			}
+		}
+		if !extended {
+			break
+		}
+	}
+	for _, rr := range msg.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && names[strings.ToLower(txt.Hdr.Name)] {
+			txts = append(txts, txt)
+		}
+	}
+	minTTL = lowestTTL(txts)
+	// The attributes expire with the first link in the chain that leads to them
+	if cnameTTL := lowestTTL(chain); len(txts) > 0 && len(chain) > 0 && cnameTTL < minTTL {
+		minTTL = cnameTTL
+	}
+	return
+}
+
+// Returns the lowest TTL of the records, or zero if there are none
+func lowestTTL[T dns.RR](rrs []T) (ttl uint32) {
+	for i, rr := range rrs {
+		if i == 0 || rr.Header().Ttl < ttl {
+			ttl = rr.Header().Ttl
+		}
+	}
 	return
 }
 
+// Get looks up the request's domain and returns its attributes
 func (req request) Get() (response Response, err error) {
-	record, err := getTxtRecord(req.Domain, req.NameServers...)
-	if err == nil {
-		response = processRecord(record)
+	return req.GetContext(context.Background())
+}
+
+// GetContext is like Get but stops as soon as ctx is done
+func (req request) GetContext(ctx context.Context) (response Response, err error) {
+	if req.Cache != nil {
+		response, err = req.Cache.get(ctx, req)
+	} else {
+		response, err = req.lookup(ctx)
+	}
+	if req.Snapshots != nil {
+		response, err = req.Snapshots.apply(req, response, err)
+	}
+	return
+}
+
+// Queries the nameservers and processes the answer, trying each name
+// from the search list in turn while the answer is NXDOMAIN
+func (req request) lookup(ctx context.Context) (response Response, err error) {
+	if req.TotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.TotalTimeout)
+		defer cancel()
+	}
+	err = req.eachName(func(candidate request) (err error) {
+		response, err = candidate.lookupName(ctx)
+		return
+	})
+	return
+}
+
+// Calls fn with a copy of req for each name from the search list in turn
+// while the result is NXDOMAIN, returning the last result
+func (req request) eachName(fn func(candidate request) error) (err error) {
+	names := req.searchNames()
+	for i, name := range names {
+		candidate := req
+		candidate.Domain = name
+		err = fn(candidate)
+		if err == nil || i == len(names)-1 || !errors.Is(err, ErrNXDOMAIN) {
+			return
+		}
+	}
+	return
+}
+
+// Returns the names to look up in turn. As with resolv.conf, a name with
+// fewer than Ndots dots is tried with each Search suffix before on its
+// own, and one with more is tried on its own first. Names ending with a
+// dot are never expanded.
+func (req request) searchNames() []string {
+	if len(req.Search) == 0 || dns.IsFqdn(req.Domain) {
+		return []string{req.Domain}
+	}
+	var names []string
+	for _, suffix := range req.Search {
+		names = append(names, dns.Fqdn(strings.TrimSuffix(req.Domain+"."+strings.Trim(suffix, "."), ".")))
+	}
+	if strings.Count(req.Domain, ".") >= req.Ndots {
+		return append([]string{req.Domain}, names...)
+	}
+	return append(names, req.Domain)
+}
+
+// Looks up the request's domain without applying the search list
+func (req request) lookupName(ctx context.Context) (response Response, err error) {
+	source := req
+	if req.Authoritative {
+		if source, err = req.authoritativeRequest(ctx); err != nil {
+			return
+		}
+	}
+	var serial uint32
+	if req.CheckSerial {
+		// Checked first so a change made between the queries is seen by the next Refresh
+		if serial, err = zoneSerial(ctx, source); err != nil {
+			return
+		}
+	}
+	if response, err = req.fetch(ctx, source); err != nil {
+		return
+	}
+	response.Serial = serial
+	return
+}
+
+// Fetches and processes the TXT records for the request's domain from
+// source, which is the request itself or its authoritative nameservers
+func (req request) fetch(ctx context.Context, source request) (response Response, err error) {
+	record, answeredBy, rtt, err := getTxtRecord(ctx, source)
+	if err != nil {
+		return
+	}
+	if req.ValidateDNSSEC {
+		if err = validateAnswer(ctx, req, record); err != nil {
+			return
+		}
+	}
+	response = processRecord(record)
+	if req.StrictDuplicates {
+		if err = checkDuplicates(response.Attributes); err != nil {
+			response = Response{}
+			return
+		}
 	}
+	response.Secure = req.ValidateDNSSEC
+	response.NameServer = answeredBy
+	response.RTT = rtt
+	response.Fetched = time.Now()
 	return
 }
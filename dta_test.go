@@ -1,211 +1,167 @@
 package dta
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
 	"strings"
+	"sync/atomic"
 	"testing"
+	"time"
 
 	"github.com/miekg/dns"
 )
 
 // All tests are numbered based on the order of examples in https://tools.ietf.org/html/rfc1464
 
-func TestGetAttribute1(t *testing.T) {
+func TestParse1(t *testing.T) {
 	expectedAttr := "color"
-	expectedValStartPos := 7
-	attr, valStartPos := getAttribute("\"color=blue\"")
-	if attr != expectedAttr {
-		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attr)
+	expectedVal := "blue"
+	attribute, err := Parse("color=blue")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if attribute.Name != expectedAttr {
+		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attribute.Name)
 	}
-	if valStartPos != expectedValStartPos {
-		t.Errorf("Expected value start position: %d", expectedValStartPos)
+	if attribute.Value != expectedVal {
+		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, attribute.Value)
 	}
 }
 
-func TestGetAttribute2(t *testing.T) {
+func TestParse2(t *testing.T) {
 	expectedAttr := "equation"
-	expectedValStartPos := 10
-	attr, valStartPos := getAttribute("\"equation=a=4\"")
-	if attr != expectedAttr {
-		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attr)
+	expectedVal := "a=4"
+	attribute, err := Parse("equation=a=4")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	if valStartPos != expectedValStartPos {
-		t.Errorf("Expected value start position: %d", expectedValStartPos)
+	if attribute.Name != expectedAttr {
+		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attribute.Name)
+	}
+	if attribute.Value != expectedVal {
+		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, attribute.Value)
 	}
 }
 
-func TestGetAttribute3(t *testing.T) {
+func TestParse3(t *testing.T) {
 	expectedAttr := "a=a"
-	expectedValStartPos := 6
-	attr, valStartPos := getAttribute("\"a`=a=true\"")
-	if attr != expectedAttr {
-		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attr)
+	expectedVal := "true"
+	attribute, err := Parse("a`=a=true")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	if valStartPos != expectedValStartPos {
-		t.Errorf("Expected value start position: %d", expectedValStartPos)
+	if attribute.Name != expectedAttr {
+		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attribute.Name)
+	}
+	if attribute.Value != expectedVal {
+		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, attribute.Value)
 	}
 }
 
-func TestGetAttribute4(t *testing.T) {
+func TestParse4(t *testing.T) {
 	expectedAttr := "a\\=a"
-	expectedValStartPos := 8
-	attr, valStartPos := getAttribute("\"a\\\\`=a=false\"")
-	if attr != expectedAttr {
-		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attr)
-	}
-	if valStartPos != expectedValStartPos {
-		t.Errorf("Expected value start position: %d", expectedValStartPos)
+	expectedVal := "false"
+	attribute, err := Parse("a\\`=a=false")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-}
-
-func TestGetAttribute5(t *testing.T) {
-	expectedAttr := "="
-	expectedValStartPos := 4
-	attr, valStartPos := getAttribute("\"`==\\\\=\"")
-	if attr != expectedAttr {
-		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attr)
+	if attribute.Name != expectedAttr {
+		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attribute.Name)
 	}
-	if valStartPos != expectedValStartPos {
-		t.Errorf("Expected value start position: %d", expectedValStartPos)
+	if attribute.Value != expectedVal {
+		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, attribute.Value)
 	}
 }
 
-func TestGetAttribute6(t *testing.T) {
-	expectedAttr := "string"
-	expectedValStartPos := 8
-	attr, valStartPos := getAttribute("\"string=\"Cat\"\"")
-	if attr != expectedAttr {
-		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attr)
-	}
-	if valStartPos != expectedValStartPos {
-		t.Errorf("Expected value start position: %d", expectedValStartPos)
+func TestParse5(t *testing.T) {
+	expectedAttr := "="
+	expectedVal := "\\="
+	attribute, err := Parse("`==\\=")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-}
-
-func TestGetAttribute7(t *testing.T) {
-	expectedAttr := "string2"
-	expectedValStartPos := 9
-	attr, valStartPos := getAttribute("\"string2=``abc``\"")
-	if attr != expectedAttr {
-		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attr)
+	if attribute.Name != expectedAttr {
+		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attribute.Name)
 	}
-	if valStartPos != expectedValStartPos {
-		t.Errorf("Expected value start position: %d", expectedValStartPos)
+	if attribute.Value != expectedVal {
+		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, attribute.Value)
 	}
 }
 
-func TestGetAttribute8(t *testing.T) {
-	expectedAttr := "novalue"
-	expectedValStartPos := 9
-	attr, valStartPos := getAttribute("\"novalue=\"")
-	if attr != expectedAttr {
-		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attr)
+func TestParse6(t *testing.T) {
+	expectedAttr := "string"
+	expectedVal := "\"Cat\""
+	attribute, err := Parse("string=\"Cat\"")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	if valStartPos != expectedValStartPos {
-		t.Errorf("Expected value start position: %d", expectedValStartPos)
+	if attribute.Name != expectedAttr {
+		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attribute.Name)
 	}
-}
-
-func TestGetAttribute9(t *testing.T) {
-	expectedAttr := "a b"
-	expectedValStartPos := 5
-	attr, valStartPos := getAttribute("\"a b=c d\"")
-	if attr != expectedAttr {
-		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attr)
-	}
-	if valStartPos != expectedValStartPos {
-		t.Errorf("Expected value start position: %d", expectedValStartPos)
+	if attribute.Value != expectedVal {
+		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, attribute.Value)
 	}
 }
 
-func TestGetAttribute10(t *testing.T) {
-	expectedAttr := "abc "
-	expectedValStartPos := 7
-	attr, valStartPos := getAttribute("\"abc` =123 \"")
-	if attr != expectedAttr {
-		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attr)
+func TestParse7(t *testing.T) {
+	expectedAttr := "string2"
+	expectedVal := "``abc``"
+	attribute, err := Parse("string2=``abc``")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-	if valStartPos != expectedValStartPos {
-		t.Errorf("Expected value start position: %d", expectedValStartPos)
+	if attribute.Name != expectedAttr {
+		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attribute.Name)
 	}
-}
-
-func TestProcessValue1(t *testing.T) {
-	expectedVal := "blue"
-	val := processValue("blue")
-	if val != expectedVal {
-		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, val)
+	if attribute.Value != expectedVal {
+		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, attribute.Value)
 	}
 }
 
-func TestProcessValue2(t *testing.T) {
-	expectedVal := "a=4"
-	val := processValue("a=4")
-	if val != expectedVal {
-		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, val)
+func TestParse8(t *testing.T) {
+	expectedAttr := "novalue"
+	expectedVal := ""
+	attribute, err := Parse("novalue=")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-}
-
-func TestProcessValue3(t *testing.T) {
-	expectedVal := "true"
-	val := processValue("true")
-	if val != expectedVal {
-		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, val)
+	if attribute.Name != expectedAttr {
+		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attribute.Name)
 	}
-}
-
-func TestProcessValue4(t *testing.T) {
-	expectedVal := "false"
-	val := processValue("false")
-	if val != expectedVal {
-		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, val)
+	if attribute.Value != expectedVal {
+		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, attribute.Value)
 	}
 }
 
-func TestProcessValue5(t *testing.T) {
-	expectedVal := "\\="
-	val := processValue("\\\\=")
-	if val != expectedVal {
-		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, val)
+func TestParse9(t *testing.T) {
+	expectedAttr := "a b"
+	expectedVal := "c d"
+	attribute, err := Parse("a b=c d")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-}
-
-func TestProcessValue6(t *testing.T) {
-	expectedVal := "\"Cat\""
-	val := processValue("\"Cat\"")
-	if val != expectedVal {
-		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, val)
+	if attribute.Name != expectedAttr {
+		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attribute.Name)
 	}
-}
-
-func TestProcessValue7(t *testing.T) {
-	expectedVal := "``abc``"
-	val := processValue("``abc``")
-	if val != expectedVal {
-		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, val)
+	if attribute.Value != expectedVal {
+		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, attribute.Value)
 	}
 }
 
-func TestProcessValue8(t *testing.T) {
-	expectedVal := ""
-	val := processValue("")
-	if val != expectedVal {
-		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, val)
+func TestParse10(t *testing.T) {
+	expectedAttr := "abc "
+	expectedVal := "123 "
+	attribute, err := Parse("abc` =123 ")
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
 	}
-}
-
-func TestProcessValue9(t *testing.T) {
-	expectedVal := "c d"
-	val := processValue("c d")
-	if val != expectedVal {
-		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, val)
+	if attribute.Name != expectedAttr {
+		t.Errorf("Expected attribute: \"%s\" but got: \"%s\"", expectedAttr, attribute.Name)
 	}
-}
-
-func TestProcessValue10(t *testing.T) {
-	expectedVal := "123 "
-	val := processValue("123 ")
-	if val != expectedVal {
-		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, val)
+	if attribute.Value != expectedVal {
+		t.Errorf("Expected value: \"%s\" but got: \"%s\"", expectedVal, attribute.Value)
 	}
 }
 
@@ -437,14 +393,6 @@ func TestMultipleNameServersWithFirstFailing(t *testing.T) {
 	}
 }
 
-func TestGetAttributeEdgeCases(t *testing.T) {
-	// Test with equals at start (should be handled by processRecord's validation)
-	attr, valStart := getAttribute("\"=invalid\"")
-	if attr != "" || valStart != 1 {
-		// Testing boundary condition where equals is first character
-	}
-}
-
 func TestProcessRecordWithInvalidEntries(t *testing.T) {
 	// Create a mock DNS response with invalid TXT entries
 	msg := &dns.Msg{}
@@ -553,3 +501,312 @@ func TestRecordErrorWithFallback(t *testing.T) {
 		}
 	}
 }
+
+// Starts a DNS server listening on both UDP and TCP on the same loopback
+// port and returns it as a NameServer
+func startServer(t *testing.T, handler dns.HandlerFunc) NameServer {
+	t.Helper()
+	return startServerWith(t, nil, handler)
+}
+
+// Like startServer but lets configure adjust each server before it starts
+func startServerWith(t *testing.T, configure func(*dns.Server), handler dns.HandlerFunc) NameServer {
+	t.Helper()
+	var pc net.PacketConn
+	var l net.Listener
+	var err error
+	// The TCP port picked by the kernel may already be taken for UDP, so retry
+	for attempt := 0; attempt < 10; attempt++ {
+		if l, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+			t.Fatalf("Failed to listen: %v", err)
+		}
+		if pc, err = net.ListenPacket("udp", l.Addr().String()); err == nil {
+			break
+		}
+		l.Close()
+	}
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	for _, server := range []*dns.Server{{PacketConn: pc, Handler: handler}, {Listener: l, Handler: handler}} {
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		if configure != nil {
+			configure(server)
+		}
+		go server.ActivateAndServe()
+		<-started
+		t.Cleanup(func() { server.Shutdown() })
+	}
+	return NameServer{Host: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port}
+}
+
+// Starts a UDP listener that never answers, simulating a black-holed nameserver
+func startBlackhole(t *testing.T) NameServer {
+	t.Helper()
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	t.Cleanup(func() { pc.Close() })
+	return NameServer{Host: "127.0.0.1", Port: pc.LocalAddr().(*net.UDPAddr).Port}
+}
+
+// Returns a handler answering every query with one TXT record per entry,
+// truncating UDP answers that don't fit the client's buffer
+func txtHandler(entries ...string) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		for _, entry := range entries {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+				Txt: []string{entry},
+			})
+		}
+		if w.LocalAddr().Network() == "udp" {
+			size := dns.MinMsgSize
+			if opt := r.IsEdns0(); opt != nil {
+				size = int(opt.UDPSize())
+			}
+			m.Truncate(size)
+		}
+		w.WriteMsg(m)
+	}
+}
+
+// Returns entries that together won't fit in a 512 byte UDP answer
+func largeEntries(count int) (entries []string) {
+	for i := 0; i < count; i++ {
+		entries = append(entries, fmt.Sprintf("attribute%d=%s", i, strings.Repeat("x", 32)))
+	}
+	return
+}
+
+func TestGetContextSkipsSlowNameServer(t *testing.T) {
+	nameserver1 := startBlackhole(t)
+	nameserver2 := startServer(t, txtHandler("color=blue"))
+	nameserver2.Priority = 1
+	request := NewRequest("example.com", nameserver1, nameserver2)
+	request.Timeout = 100 * time.Millisecond
+	start := time.Now()
+	res, err := request.GetContext(context.Background())
+	if err != nil {
+		t.Fatalf("Expected success from second nameserver, got error: %v", err)
+	}
+	if res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue, got %v", res.Config)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected per-nameserver timeout to apply, lookup took %s", elapsed)
+	}
+}
+
+func TestGetContextTotalTimeout(t *testing.T) {
+	request := NewRequest("example.com", startBlackhole(t), startBlackhole(t))
+	request.Timeout = time.Second
+	request.TotalTimeout = 150 * time.Millisecond
+	start := time.Now()
+	_, err := request.GetContext(context.Background())
+	if !errors.Is(err, ErrDeadlineExceeded) {
+		t.Errorf("Expected ErrDeadlineExceeded, got: %v", err)
+	}
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded in chain, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected overall deadline to apply, lookup took %s", elapsed)
+	}
+}
+
+func TestGetContextCancelled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	request := NewRequest("example.com", startServer(t, txtHandler("color=blue")))
+	_, err := request.GetContext(ctx)
+	if !errors.Is(err, context.Canceled) {
+		t.Errorf("Expected context.Canceled, got: %v", err)
+	}
+	if errors.Is(err, ErrDeadlineExceeded) {
+		t.Errorf("Cancellation should not be reported as a deadline: %v", err)
+	}
+}
+
+func TestTruncatedResponseRetriedOverTCP(t *testing.T) {
+	entries := largeEntries(40)
+	request := NewRequest("example.com", startServer(t, txtHandler(entries...)))
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(res.Config) != len(entries) {
+		t.Errorf("Expected %d attributes, got %d", len(entries), len(res.Config))
+	}
+}
+
+func TestForceTCP(t *testing.T) {
+	networks := make(chan string, 1)
+	handler := txtHandler("color=blue")
+	nameserver := startServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		networks <- w.LocalAddr().Network()
+		handler(w, r)
+	})
+	request := NewRequest("example.com", nameserver)
+	request.ForceTCP = true
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if network := <-networks; network != "tcp" {
+		t.Errorf("Expected query over tcp, got: %s", network)
+	}
+	if res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue, got %v", res.Config)
+	}
+}
+
+func TestEDNS0BufferSizeAvoidsTCP(t *testing.T) {
+	entries := largeEntries(40)
+	handler := txtHandler(entries...)
+	var tcpQueries atomic.Int32
+	nameserver := startServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if w.LocalAddr().Network() == "tcp" {
+			tcpQueries.Add(1)
+		}
+		handler(w, r)
+	})
+	request := NewRequest("example.com", nameserver)
+	request.EDNS0BufferSize = 4096
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if len(res.Config) != len(entries) {
+		t.Errorf("Expected %d attributes, got %d", len(entries), len(res.Config))
+	}
+	if n := tcpQueries.Load(); n != 0 {
+		t.Errorf("Expected answer to fit in a single UDP response, got %d TCP queries", n)
+	}
+}
+
+func TestEDNS0Options(t *testing.T) {
+	opts := make(chan *dns.OPT, 1)
+	handler := txtHandler("color=blue")
+	nameserver := startServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		opts <- r.IsEdns0()
+		handler(w, r)
+	})
+	request := NewRequest("example.com", nameserver)
+	request.EDNS0DO = true
+	request.EDNS0Options = []dns.EDNS0{&dns.EDNS0_SUBNET{
+		Code:          dns.EDNS0SUBNET,
+		Family:        1,
+		SourceNetmask: 24,
+		Address:       net.ParseIP("198.51.100.0").To4(),
+	}}
+	if _, err := request.Get(); err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	opt := <-opts
+	if opt == nil {
+		t.Fatalf("Expected query to carry an OPT record")
+	}
+	if opt.UDPSize() != defaultEDNS0BufferSize {
+		t.Errorf("Expected default buffer size %d, got %d", defaultEDNS0BufferSize, opt.UDPSize())
+	}
+	if !opt.Do() {
+		t.Errorf("Expected DO bit to be set")
+	}
+	if len(opt.Option) != 1 || opt.Option[0].Option() != dns.EDNS0SUBNET {
+		t.Errorf("Expected client subnet option, got %v", opt.Option)
+	}
+}
+
+func TestNoEDNS0ByDefault(t *testing.T) {
+	m := newQuery(NewRequest("example.com"), "example.com", dns.TypeTXT)
+	if m.IsEdns0() != nil {
+		t.Errorf("Expected no OPT record by default")
+	}
+}
+
+func TestProcessRecordMultipleStrings(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("test.com.", dns.TypeTXT)
+	msg.Answer = append(msg.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: "test.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+		Txt: []string{"key=part1", " part2"},
+	})
+	response := processRecord(msg)
+	if response.Config["key"] != "part1 part2" {
+		t.Errorf("Expected key=part1 part2, got %v", response.Config)
+	}
+}
+
+func TestProcessRecordValueContainingTXT(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("test.com.", dns.TypeTXT)
+	msg.Answer = append(msg.Answer, &dns.TXT{
+		Hdr: dns.RR_Header{Name: "test.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+		Txt: []string{"format=TXT record"},
+	})
+	response := processRecord(msg)
+	if response.Config["format"] != "TXT record" {
+		t.Errorf("Expected format=TXT record, got %v", response.Config)
+	}
+}
+
+func TestProcessRecordFollowsCNAME(t *testing.T) {
+	msg := new(dns.Msg)
+	msg.SetQuestion("alias.test.com.", dns.TypeTXT)
+	msg.Answer = append(msg.Answer,
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "alias.test.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+			Target: "middle.test.com.",
+		},
+		// Out of order links in the chain are still followed
+		&dns.TXT{
+			Hdr: dns.RR_Header{Name: "Target.test.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{"color=blue"},
+		},
+		&dns.CNAME{
+			Hdr:    dns.RR_Header{Name: "middle.test.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 300},
+			Target: "target.test.com.",
+		},
+		&dns.TXT{
+			Hdr: dns.RR_Header{Name: "unrelated.test.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{"color=red"},
+		},
+		&dns.A{
+			Hdr: dns.RR_Header{Name: "target.test.com.", Rrtype: dns.TypeA, Class: dns.ClassINET, Ttl: 300},
+			A:   net.ParseIP("192.0.2.1"),
+		},
+	)
+	response := processRecord(msg)
+	if len(response.Config) != 1 || response.Config["color"] != "blue" {
+		t.Errorf("Expected only color=blue, got %v", response.Config)
+	}
+}
+
+func TestProcessRecordEscapedStrings(t *testing.T) {
+	// The dns package escapes quotes, backslashes and unprintable bytes
+	msg := new(dns.Msg)
+	msg.SetQuestion("test.com.", dns.TypeTXT)
+	for _, s := range []string{
+		"test.com. 300 IN TXT \"a\\\\`=a=false\"",
+		"test.com. 300 IN TXT \"string=\\\"Cat\\\"\"",
+		"test.com. 300 IN TXT \"tab=a\\009b\"",
+	} {
+		rr, err := dns.NewRR(s)
+		if err != nil {
+			t.Fatalf("Failed to parse record: %v", err)
+		}
+		msg.Answer = append(msg.Answer, rr)
+	}
+	response := processRecord(msg)
+	expected := map[string]string{"a\\=a": "false", "string": "\"Cat\"", "tab": "a\tb"}
+	for attr, val := range expected {
+		if response.Config[attr] != val {
+			t.Errorf("Expected %s=%q, got %v", attr, val, response.Config)
+		}
+	}
+}
@@ -0,0 +1,149 @@
+package dta
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	// ErrNXDOMAIN is matched when a nameserver reports the domain doesn't exist
+	ErrNXDOMAIN = errors.New("NXDOMAIN")
+	// ErrSERVFAIL is matched when a nameserver failed to process the query
+	ErrSERVFAIL = errors.New("SERVFAIL")
+	// ErrREFUSED is matched when a nameserver refused to answer
+	ErrREFUSED = errors.New("REFUSED")
+	// ErrTimeout is matched when a nameserver didn't answer in time
+	ErrTimeout = errors.New("timeout")
+	// ErrNetwork is matched when a nameserver couldn't be reached
+	ErrNetwork = errors.New("network error")
+	// ErrTruncated is matched when a complete answer couldn't be retrieved
+	ErrTruncated = errors.New("truncated response")
+	// ErrAllServersFailed is matched when no nameserver returned an answer
+	ErrAllServersFailed = errors.New("all nameservers failed")
+	// ErrDuplicateAttribute is matched in strict mode when an attribute has several values
+	ErrDuplicateAttribute = errors.New("duplicate attribute")
+)
+
+// RcodeError is returned when a nameserver answers with an unsuccessful rcode
+type RcodeError struct {
+	Rcode int
+	// Msg is the answer as received
+	Msg *dns.Msg
+}
+
+func (e *RcodeError) Error() string {
+	if s, ok := dns.RcodeToString[e.Rcode]; ok {
+		return s
+	}
+	return fmt.Sprintf("RCODE%d", e.Rcode)
+}
+
+// Is matches the sentinel error for the rcode
+func (e *RcodeError) Is(target error) bool {
+	switch target {
+	case ErrNXDOMAIN:
+		return e.Rcode == dns.RcodeNameError
+	case ErrSERVFAIL:
+		return e.Rcode == dns.RcodeServerFailure
+	case ErrREFUSED:
+		return e.Rcode == dns.RcodeRefused
+	}
+	return false
+}
+
+// NameServerError records why a single nameserver failed to answer
+type NameServerError struct {
+	NameServer NameServer
+	Err        error
+}
+
+func (e *NameServerError) Error() string {
+	return e.NameServer.endpoint() + ": " + e.Err.Error()
+}
+
+func (e *NameServerError) Unwrap() error {
+	return e.Err
+}
+
+// LookupError is returned when a lookup fails, with one entry
+// per nameserver tried. Err is set if the lookup was cut short
+// by its context, otherwise the error matches ErrAllServersFailed.
+type LookupError struct {
+	Domain string
+	Errors []*NameServerError
+	Err    error
+}
+
+func (e *LookupError) Error() string {
+	var reasons []string
+	if e.Err != nil {
+		reasons = append(reasons, e.Err.Error())
+	} else if len(e.Errors) == 0 {
+		reasons = append(reasons, "no nameservers to query")
+	}
+	for _, nsErr := range e.Errors {
+		reasons = append(reasons, nsErr.Error())
+	}
+	return "lookup " + e.Domain + ": " + strings.Join(reasons, "; ")
+}
+
+// Is reports whether every nameserver was tried without success
+func (e *LookupError) Is(target error) bool {
+	return target == ErrAllServersFailed && e.Err == nil
+}
+
+// Unwrap returns the per-nameserver errors so each can be matched with errors.Is and errors.As
+func (e *LookupError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Errors)+1)
+	if e.Err != nil {
+		errs = append(errs, e.Err)
+	}
+	for _, nsErr := range e.Errors {
+		errs = append(errs, nsErr)
+	}
+	return errs
+}
+
+// DuplicateAttributeError is returned by strict lookups when an
+// attribute name, ignoring case, appears more than once
+type DuplicateAttributeError struct {
+	Name   string
+	Values []string
+}
+
+func (e *DuplicateAttributeError) Error() string {
+	return fmt.Sprintf("%s: %q has %d values", ErrDuplicateAttribute, e.Name, len(e.Values))
+}
+
+func (e *DuplicateAttributeError) Is(target error) bool {
+	return target == ErrDuplicateAttribute
+}
+
+// Attaches a sentinel to an error without changing its message
+type kindError struct {
+	kind error
+	err  error
+}
+
+func (e *kindError) Error() string   { return e.err.Error() }
+func (e *kindError) Unwrap() []error { return []error{e.kind, e.err} }
+
+// Tags transport errors as timeouts or network errors
+func classifyError(err error) error {
+	var netErr net.Error
+	switch {
+	case errors.Is(err, ErrTimeout), errors.Is(err, ErrNetwork):
+		return err
+	case errors.Is(err, context.DeadlineExceeded), errors.As(err, &netErr) && netErr.Timeout():
+		return &kindError{kind: ErrTimeout, err: err}
+	case errors.As(err, &netErr), errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return &kindError{kind: ErrNetwork, err: err}
+	}
+	return err
+}
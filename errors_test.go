@@ -0,0 +1,146 @@
+package dta
+
+import (
+	"errors"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Returns a handler answering every query with rcode
+func rcodeHandler(rcode int) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, rcode)
+		w.WriteMsg(m)
+	}
+}
+
+func TestRcodeErrors(t *testing.T) {
+	for rcode, sentinel := range map[int]error{
+		dns.RcodeNameError:     ErrNXDOMAIN,
+		dns.RcodeServerFailure: ErrSERVFAIL,
+		dns.RcodeRefused:       ErrREFUSED,
+	} {
+		_, err := NewRequest("example.com", startServer(t, rcodeHandler(rcode))).Get()
+		if !errors.Is(err, sentinel) {
+			t.Errorf("Expected %v, got: %v", sentinel, err)
+		}
+		if !errors.Is(err, ErrAllServersFailed) {
+			t.Errorf("Expected ErrAllServersFailed, got: %v", err)
+		}
+		var rcodeErr *RcodeError
+		if !errors.As(err, &rcodeErr) || rcodeErr.Rcode != rcode {
+			t.Errorf("Expected RcodeError with rcode %d, got: %v", rcode, err)
+		}
+		if !strings.Contains(err.Error(), dns.RcodeToString[rcode]) {
+			t.Errorf("Expected error message to name the rcode, got: %v", err)
+		}
+	}
+}
+
+func TestRcodeErrorUnknownRcode(t *testing.T) {
+	err := &RcodeError{Rcode: 4000}
+	if err.Error() != "RCODE4000" {
+		t.Errorf("Expected RCODE4000, got: %s", err)
+	}
+	if errors.Is(err, ErrNXDOMAIN) || errors.Is(err, ErrSERVFAIL) || errors.Is(err, ErrREFUSED) {
+		t.Errorf("Unexpected match for unknown rcode")
+	}
+}
+
+func TestTimeoutError(t *testing.T) {
+	request := NewRequest("example.com", startBlackhole(t))
+	request.Timeout = 50 * time.Millisecond
+	_, err := request.Get()
+	if !errors.Is(err, ErrTimeout) {
+		t.Errorf("Expected ErrTimeout, got: %v", err)
+	}
+	if errors.Is(err, ErrNetwork) {
+		t.Errorf("Timeout should not be reported as a network error: %v", err)
+	}
+}
+
+func TestNetworkError(t *testing.T) {
+	// Nothing listens on a port we've just released
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	l.Close()
+	request := NewRequest("example.com", NameServer{Host: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port})
+	request.ForceTCP = true
+	_, err = request.Get()
+	if !errors.Is(err, ErrNetwork) {
+		t.Errorf("Expected ErrNetwork, got: %v", err)
+	}
+	if !errors.Is(err, ErrAllServersFailed) {
+		t.Errorf("Expected ErrAllServersFailed, got: %v", err)
+	}
+}
+
+func TestTruncatedError(t *testing.T) {
+	// A UDP-only server can't complete the retry over TCP
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{PacketConn: pc, Handler: txtHandler(largeEntries(40)...), NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	defer server.Shutdown()
+	request := NewRequest("example.com", NameServer{Host: "127.0.0.1", Port: pc.LocalAddr().(*net.UDPAddr).Port})
+	_, err = request.Get()
+	if !errors.Is(err, ErrTruncated) {
+		t.Errorf("Expected ErrTruncated, got: %v", err)
+	}
+	if !errors.Is(err, ErrNetwork) {
+		t.Errorf("Expected the TCP failure to be kept, got: %v", err)
+	}
+}
+
+func TestLookupErrorPerNameServer(t *testing.T) {
+	nameserver1 := startServer(t, rcodeHandler(dns.RcodeServerFailure))
+	nameserver2 := startServer(t, rcodeHandler(dns.RcodeNameError))
+	nameserver2.Priority = 1
+	_, err := NewRequest("example.com", nameserver1, nameserver2).Get()
+	var lookupErr *LookupError
+	if !errors.As(err, &lookupErr) {
+		t.Fatalf("Expected LookupError, got: %v", err)
+	}
+	if lookupErr.Domain != "example.com." {
+		t.Errorf("Expected domain example.com., got: %s", lookupErr.Domain)
+	}
+	if len(lookupErr.Errors) != 2 {
+		t.Fatalf("Expected an error per nameserver, got: %v", lookupErr.Errors)
+	}
+	if lookupErr.Errors[0].NameServer.Port != nameserver1.Port || !errors.Is(lookupErr.Errors[0], ErrSERVFAIL) {
+		t.Errorf("Expected SERVFAIL from first nameserver, got: %v", lookupErr.Errors[0])
+	}
+	if lookupErr.Errors[1].NameServer.Port != nameserver2.Port || !errors.Is(lookupErr.Errors[1], ErrNXDOMAIN) {
+		t.Errorf("Expected NXDOMAIN from second nameserver, got: %v", lookupErr.Errors[1])
+	}
+}
+
+func TestLookupErrorDeadline(t *testing.T) {
+	request := NewRequest("example.com", startBlackhole(t))
+	request.TotalTimeout = 50 * time.Millisecond
+	_, err := request.Get()
+	if !errors.Is(err, ErrDeadlineExceeded) {
+		t.Errorf("Expected ErrDeadlineExceeded, got: %v", err)
+	}
+	if errors.Is(err, ErrAllServersFailed) {
+		t.Errorf("Deadline should not be reported as every nameserver failing: %v", err)
+	}
+}
+
+func TestLookupErrorNoNameServers(t *testing.T) {
+	_, err := NewRequest("example.com").Get()
+	if !errors.Is(err, ErrAllServersFailed) {
+		t.Errorf("Expected ErrAllServersFailed, got: %v", err)
+	}
+}
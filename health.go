@@ -0,0 +1,166 @@
+package dta
+
+import (
+	"context"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Weight given to the latest query in the moving averages
+const healthDecay = 0.2
+
+// HealthTracker records how each nameserver has been answering so lookups
+// try the healthiest nameservers of each priority first. A nameserver that
+// fails FailureThreshold times in a row is skipped until Cooldown passes,
+// unless every nameserver is failing. A HealthTracker is safe for
+// concurrent use and is meant to be shared between requests.
+type HealthTracker struct {
+	// FailureThreshold is how many consecutive failures open the circuit.
+	// Zero never opens it.
+	FailureThreshold int
+	// Cooldown is how long an open circuit lasts before the nameserver is tried again
+	Cooldown time.Duration
+
+	mu      sync.Mutex
+	servers map[string]*NameServerHealth
+	now     func() time.Time
+}
+
+// NameServerHealth is what a HealthTracker knows about a nameserver
+type NameServerHealth struct {
+	// SuccessRate is a moving average of successful queries, from 0 to 1
+	SuccessRate float64
+	// Latency is a moving average of the round trip time of answers
+	Latency time.Duration
+	// ConsecutiveFailures counts failures since the last success
+	ConsecutiveFailures int
+	// LastFailure is when the nameserver last failed
+	LastFailure time.Time
+}
+
+// NewHealthTracker returns a tracker that skips nameservers for cooldown
+// after failureThreshold consecutive failures
+func NewHealthTracker(failureThreshold int, cooldown time.Duration) *HealthTracker {
+	return &HealthTracker{FailureThreshold: failureThreshold, Cooldown: cooldown}
+}
+
+func (h *HealthTracker) clock() time.Time {
+	if h.now != nil {
+		return h.now()
+	}
+	return time.Now()
+}
+
+// Health returns what's known about nameserver. ok is false if it hasn't been queried.
+func (h *HealthTracker) Health(nameserver NameServer) (health NameServerHealth, ok bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if server, found := h.servers[nameserver.key()]; found {
+		return *server, true
+	}
+	return
+}
+
+// Open reports whether nameserver is being skipped after repeated failures
+func (h *HealthTracker) Open(nameserver NameServer) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.open(h.servers[nameserver.key()], h.clock())
+}
+
+func (h *HealthTracker) open(server *NameServerHealth, now time.Time) bool {
+	return server != nil && h.FailureThreshold > 0 &&
+		server.ConsecutiveFailures >= h.FailureThreshold &&
+		now.Sub(server.LastFailure) < h.Cooldown
+}
+
+// Records the outcome of an exchange with nameserver. Answers other than
+// NXDOMAIN with an unsuccessful rcode count as failures. Failures caused
+// by ctx finishing say nothing about the nameserver and are ignored.
+func (h *HealthTracker) record(ctx context.Context, nameserver NameServer, answer *dns.Msg, err error, rtt time.Duration) {
+	if h == nil || (err != nil && contextDone(ctx)) {
+		return
+	}
+	success := err == nil && (answer.Rcode == dns.RcodeSuccess || answer.Rcode == dns.RcodeNameError)
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key := nameserver.key()
+	server, ok := h.servers[key]
+	if !ok {
+		if h.servers == nil {
+			h.servers = make(map[string]*NameServerHealth)
+		}
+		server = &NameServerHealth{SuccessRate: 1}
+		h.servers[key] = server
+	}
+	if success {
+		server.SuccessRate += healthDecay * (1 - server.SuccessRate)
+		server.ConsecutiveFailures = 0
+	} else {
+		server.SuccessRate -= healthDecay * server.SuccessRate
+		server.ConsecutiveFailures++
+		server.LastFailure = h.clock()
+	}
+	// Timeouts don't measure how quickly the nameserver answers
+	if err == nil {
+		if !ok || server.Latency == 0 {
+			server.Latency = rtt
+		} else {
+			server.Latency += time.Duration(healthDecay * float64(rtt-server.Latency))
+		}
+	}
+}
+
+// Returns nameservers, which are ordered by priority, with the healthiest
+// first within each priority and nameservers with an open circuit last.
+// Weighted nameservers keep their order unless they've been failing so
+// the load is still shared.
+func (h *HealthTracker) order(nameservers []NameServer) []NameServer {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	now := h.clock()
+	weighted := make(map[int]bool)
+	for _, nameserver := range nameservers {
+		if nameserver.Weight > 0 {
+			weighted[nameserver.Priority] = true
+		}
+	}
+	type ranked struct {
+		nameserver NameServer
+		health     NameServerHealth
+		open       bool
+	}
+	ranking := make([]ranked, len(nameservers))
+	for i, nameserver := range nameservers {
+		// Nameservers that haven't been queried are assumed healthy
+		ranking[i] = ranked{nameserver: nameserver, health: NameServerHealth{SuccessRate: 1}}
+		if server, ok := h.servers[nameserver.key()]; ok {
+			ranking[i].health = *server
+			ranking[i].open = h.open(server, now)
+		}
+	}
+	sort.SliceStable(ranking, func(i, j int) bool {
+		a, b := ranking[i], ranking[j]
+		if a.open != b.open {
+			return !a.open
+		}
+		if a.nameserver.Priority != b.nameserver.Priority {
+			return a.nameserver.Priority < b.nameserver.Priority
+		}
+		if weighted[a.nameserver.Priority] {
+			return a.health.ConsecutiveFailures == 0 && b.health.ConsecutiveFailures > 0
+		}
+		if a.health.SuccessRate != b.health.SuccessRate {
+			return a.health.SuccessRate > b.health.SuccessRate
+		}
+		return a.health.Latency < b.health.Latency
+	})
+	ordered := make([]NameServer, len(ranking))
+	for i, r := range ranking {
+		ordered[i] = r.nameserver
+	}
+	return ordered
+}
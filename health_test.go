@@ -0,0 +1,138 @@
+package dta
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Returns a tracker using a fake clock
+func newTestHealthTracker(failureThreshold int, cooldown time.Duration) (*HealthTracker, *fakeClock) {
+	clock := newFakeClock()
+	tracker := NewHealthTracker(failureThreshold, cooldown)
+	tracker.now = clock.Now
+	return tracker, clock
+}
+
+func TestHealthRecord(t *testing.T) {
+	tracker, clock := newTestHealthTracker(2, time.Minute)
+	nameserver := NameServer{Host: "192.0.2.1"}
+	if _, ok := tracker.Health(nameserver); ok {
+		t.Errorf("Expected no health for a nameserver not yet queried")
+	}
+	ctx := context.Background()
+	tracker.record(ctx, nameserver, &dns.Msg{}, nil, 10*time.Millisecond)
+	tracker.record(ctx, nameserver, &dns.Msg{}, nil, 20*time.Millisecond)
+	health, _ := tracker.Health(nameserver)
+	if health.SuccessRate != 1 || health.Latency != 12*time.Millisecond {
+		t.Errorf("Expected success rate 1 and latency 12ms, got %v and %s", health.SuccessRate, health.Latency)
+	}
+
+	tracker.record(ctx, nameserver, nil, ErrTimeout, 2*time.Second)
+	servfail := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeServerFailure}}
+	tracker.record(ctx, nameserver, servfail, nil, time.Millisecond)
+	health, _ = tracker.Health(nameserver)
+	if health.ConsecutiveFailures != 2 || health.SuccessRate >= 1 {
+		t.Errorf("Expected 2 consecutive failures and a lower success rate, got %+v", health)
+	}
+	if !tracker.Open(nameserver) {
+		t.Errorf("Expected circuit to open after 2 failures")
+	}
+	clock.Advance(time.Minute)
+	if tracker.Open(nameserver) {
+		t.Errorf("Expected circuit to close after the cooldown")
+	}
+
+	nxdomain := &dns.Msg{MsgHdr: dns.MsgHdr{Rcode: dns.RcodeNameError}}
+	tracker.record(ctx, nameserver, nxdomain, nil, time.Millisecond)
+	if health, _ = tracker.Health(nameserver); health.ConsecutiveFailures != 0 {
+		t.Errorf("Expected NXDOMAIN to count as success, got %+v", health)
+	}
+}
+
+func TestHealthIgnoresCancelled(t *testing.T) {
+	tracker, _ := newTestHealthTracker(1, time.Minute)
+	nameserver := NameServer{Host: "192.0.2.1"}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tracker.record(ctx, nameserver, nil, context.Canceled, time.Millisecond)
+	if _, ok := tracker.Health(nameserver); ok {
+		t.Errorf("Expected failures from a cancelled lookup to be ignored")
+	}
+}
+
+func TestHealthOrder(t *testing.T) {
+	tracker, _ := newTestHealthTracker(3, time.Minute)
+	ctx := context.Background()
+	a := NameServer{Host: "192.0.2.1", Priority: 1}
+	b := NameServer{Host: "192.0.2.2", Priority: 1}
+	c := NameServer{Host: "192.0.2.3", Priority: 2}
+	d := NameServer{Host: "192.0.2.4", Priority: 2}
+	tracker.record(ctx, a, nil, ErrTimeout, 0)
+	tracker.record(ctx, b, &dns.Msg{}, nil, time.Millisecond)
+	tracker.record(ctx, c, &dns.Msg{}, nil, 50*time.Millisecond)
+	tracker.record(ctx, d, &dns.Msg{}, nil, 5*time.Millisecond)
+	expected := []NameServer{b, a, d, c}
+	got := tracker.order([]NameServer{a, b, c, d})
+	for i := range expected {
+		if got[i].Host != expected[i].Host {
+			t.Fatalf("Expected order %v, got %v", expected, got)
+		}
+	}
+
+	// An open circuit moves a nameserver behind every other priority
+	tracker.record(ctx, b, nil, ErrTimeout, 0)
+	tracker.record(ctx, b, nil, ErrTimeout, 0)
+	tracker.record(ctx, b, nil, ErrTimeout, 0)
+	expected = []NameServer{a, d, c, b}
+	got = tracker.order([]NameServer{a, b, c, d})
+	for i := range expected {
+		if got[i].Host != expected[i].Host {
+			t.Fatalf("Expected order %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestHealthReordersLookups(t *testing.T) {
+	var failingQueries atomic.Int32
+	failing := startServer(t, countingHandler(&failingQueries, rcodeHandler(dns.RcodeServerFailure)))
+	good := startServer(t, txtHandler("color=blue"))
+	tracker, clock := newTestHealthTracker(1, time.Minute)
+	for i := 0; i < 3; i++ {
+		request := NewRequest("example.com", failing, good)
+		request.Health = tracker
+		if _, err := request.Get(); err != nil {
+			t.Fatalf("Expected response, got: %v", err)
+		}
+	}
+	if got := failingQueries.Load(); got != 1 {
+		t.Errorf("Expected the failing nameserver to be tried once, got %d", got)
+	}
+
+	// Once the cooldown passes the failing nameserver is tried again, but
+	// only after the healthier one of the same priority
+	clock.Advance(time.Minute)
+	request := NewRequest("example.com", failing, good)
+	request.Health = tracker
+	request.Get()
+	if got := failingQueries.Load(); got != 1 {
+		t.Errorf("Expected the healthier nameserver to answer first, got %d queries to the failing one", got)
+	}
+}
+
+func TestHealthAllOpen(t *testing.T) {
+	var queries atomic.Int32
+	tracker, _ := newTestHealthTracker(1, time.Hour)
+	nameserver := startServer(t, countingHandler(&queries, rcodeHandler(dns.RcodeServerFailure)))
+	request := NewRequest("example.com", nameserver)
+	request.Health = tracker
+	request.Get()
+	// A nameserver with an open circuit is still tried when it's the only option
+	if _, err := request.Get(); !errors.Is(err, ErrSERVFAIL) || queries.Load() != 2 {
+		t.Errorf("Expected a second SERVFAIL query, got %d queries and: %v", queries.Load(), err)
+	}
+}
@@ -0,0 +1,75 @@
+package dta
+
+import (
+	"context"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// The outcome of an exchange with the nameserver at index
+type hedgedResult struct {
+	index  int
+	record *dns.Msg
+	rtt    time.Duration
+	err    error
+}
+
+// Like query but starts on the next nameserver each time HedgeDelay passes
+// or a nameserver fails. The first successful answer is returned and the
+// exchanges still in progress are cancelled.
+func hedgedQuery(ctx context.Context, req request, m *dns.Msg) (answer *dns.Msg, answeredBy NameServer, rtt time.Duration, err error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	results := make(chan hedgedResult, len(req.NameServers))
+	failures := make([]*NameServerError, len(req.NameServers))
+	timer := time.NewTimer(req.HedgeDelay)
+	defer timer.Stop()
+	next, pending := 0, 0
+	startNext := func() {
+		if next == len(req.NameServers) || contextDone(ctx) {
+			return
+		}
+		index, msg := next, m.Copy()
+		next++
+		pending++
+		timer.Reset(req.HedgeDelay)
+		go func() {
+			start := time.Now()
+			record, exchangeErr := exchange(ctx, req, msg, req.NameServers[index])
+			elapsed := time.Since(start)
+			req.Health.record(ctx, req.NameServers[index], record, exchangeErr, elapsed)
+			results <- hedgedResult{index: index, record: record, rtt: elapsed, err: exchangeErr}
+		}()
+	}
+	startNext()
+	for pending > 0 {
+		select {
+		case <-timer.C:
+			startNext()
+		case result := <-results:
+			pending--
+			nameserver := req.NameServers[result.index]
+			switch {
+			case result.err != nil:
+				failures[result.index] = &NameServerError{NameServer: nameserver, Err: classifyError(result.err)}
+			case result.record.Rcode != dns.RcodeSuccess:
+				failures[result.index] = &NameServerError{NameServer: nameserver, Err: &RcodeError{Rcode: result.record.Rcode, Msg: result.record}}
+			default:
+				return result.record, nameserver, result.rtt, nil
+			}
+			startNext()
+		}
+	}
+	// Failures are reported in nameserver order whatever order they happened in
+	lookupErr := &LookupError{Domain: m.Question[0].Name}
+	for _, failure := range failures {
+		if failure != nil {
+			lookupErr.Errors = append(lookupErr.Errors, failure)
+		}
+	}
+	if contextDone(ctx) {
+		lookupErr.Err = contextError(ctx)
+	}
+	return nil, answeredBy, 0, lookupErr
+}
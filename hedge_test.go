@@ -0,0 +1,100 @@
+package dta
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Returns a handler that waits for delay before answering with handler
+func slowHandler(delay time.Duration, handler dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		time.Sleep(delay)
+		handler(w, r)
+	}
+}
+
+func TestHedgeSkipsBlackhole(t *testing.T) {
+	nameserver1 := startBlackhole(t)
+	nameserver1.Priority = 1
+	nameserver2 := startServer(t, txtHandler("color=blue"))
+	nameserver2.Priority = 2
+	request := NewRequest("example.com", nameserver1, nameserver2)
+	request.Timeout = 5 * time.Second
+	request.HedgeDelay = 50 * time.Millisecond
+	start := time.Now()
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Expected response, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected hedged answer well before the timeout, took %s", elapsed)
+	}
+	if res.NameServer.Port != nameserver2.Port || res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue from the second nameserver, got %v from %+v", res.Config, res.NameServer)
+	}
+}
+
+func TestHedgeFirstAnswerWins(t *testing.T) {
+	slow := startServer(t, slowHandler(500*time.Millisecond, txtHandler("speed=slow")))
+	slow.Priority = 1
+	fast := startServer(t, txtHandler("speed=fast"))
+	fast.Priority = 2
+	request := NewRequest("example.com", slow, fast)
+	request.HedgeDelay = 20 * time.Millisecond
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Expected response, got: %v", err)
+	}
+	if res.Config["speed"] != "fast" {
+		t.Errorf("Expected the faster answer, got %v", res.Config)
+	}
+}
+
+func TestHedgeFailureStartsNext(t *testing.T) {
+	failing := startServer(t, rcodeHandler(dns.RcodeServerFailure))
+	failing.Priority = 1
+	good := startServer(t, txtHandler("color=blue"))
+	good.Priority = 2
+	request := NewRequest("example.com", failing, good)
+	request.HedgeDelay = 5 * time.Second
+	start := time.Now()
+	if _, err := request.Get(); err != nil {
+		t.Fatalf("Expected response, got: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected a failure to start the next nameserver without waiting, took %s", elapsed)
+	}
+}
+
+func TestHedgeAllFail(t *testing.T) {
+	nameserver1 := startServer(t, slowHandler(100*time.Millisecond, rcodeHandler(dns.RcodeServerFailure)))
+	nameserver1.Priority = 1
+	nameserver2 := startServer(t, rcodeHandler(dns.RcodeRefused))
+	nameserver2.Priority = 2
+	request := NewRequest("example.com", nameserver1, nameserver2)
+	request.HedgeDelay = 10 * time.Millisecond
+	_, err := request.Get()
+	var lookupErr *LookupError
+	if !errors.As(err, &lookupErr) || !errors.Is(err, ErrAllServersFailed) {
+		t.Fatalf("Expected LookupError for all nameservers failing, got: %v", err)
+	}
+	if len(lookupErr.Errors) != 2 || !errors.Is(lookupErr.Errors[0], ErrSERVFAIL) || !errors.Is(lookupErr.Errors[1], ErrREFUSED) {
+		t.Errorf("Expected SERVFAIL then REFUSED in nameserver order, got: %v", err)
+	}
+}
+
+func TestHedgeDeadline(t *testing.T) {
+	nameserver1 := startBlackhole(t)
+	nameserver2 := startBlackhole(t)
+	request := NewRequest("example.com", nameserver1, nameserver2)
+	request.HedgeDelay = 10 * time.Millisecond
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	if _, err := request.GetContext(ctx); !errors.Is(err, ErrDeadlineExceeded) {
+		t.Errorf("Expected ErrDeadlineExceeded, got: %v", err)
+	}
+}
@@ -0,0 +1,163 @@
+package dta
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// NotifyListener accepts NOTIFY messages (RFC 1996) from a zone's primary
+// and refreshes the requests registered for domains in the notified zone,
+// so changes are seen without waiting for the next poll.
+type NotifyListener struct {
+	// Addr is the address ListenAndServe listens on over UDP and TCP
+	Addr string
+	// TSIG, if set, is required to have signed every NOTIFY. When serving
+	// with a dns.Server other than through ListenAndServe the key must be
+	// in its TsigSecret.
+	TSIG *TSIGKey
+	// RefreshTimeout bounds each refresh, defaulting to 30 seconds
+	RefreshTimeout time.Duration
+
+	mu            sync.Mutex
+	registrations []*notifyRegistration
+}
+
+type notifyRegistration struct {
+	req request
+	fn  func(Response, error)
+	// Set while a refresh is running, and when another NOTIFY arrived
+	// during it so it has to run again. Guarded by the listener's mutex.
+	running bool
+	pending bool
+}
+
+// How long a refresh triggered by a NOTIFY may take by default
+const defaultNotifyRefreshTimeout = 30 * time.Second
+
+// NewNotifyListener returns a listener for addr
+func NewNotifyListener(addr string) *NotifyListener {
+	return &NotifyListener{Addr: addr}
+}
+
+// Register looks up req again each time a NOTIFY arrives for the zone
+// containing its domain and passes the result to fn. Any cached response
+// for req is discarded first. Only one refresh of req runs at a time, and
+// NOTIFYs arriving during it cause a single further refresh.
+func (l *NotifyListener) Register(req request, fn func(Response, error)) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.registrations = append(l.registrations, &notifyRegistration{req: req, fn: fn})
+}
+
+// ListenAndServe handles NOTIFY messages sent to Addr until ctx is done
+func (l *NotifyListener) ListenAndServe(ctx context.Context) error {
+	errs := make(chan error, 2)
+	var servers []*dns.Server
+	defer func() {
+		for _, server := range servers {
+			server.Shutdown()
+		}
+	}()
+	for _, network := range []string{"udp", "tcp"} {
+		server := &dns.Server{Addr: l.Addr, Net: network, Handler: l}
+		if l.TSIG != nil {
+			server.TsigSecret = map[string]string{l.TSIG.name(): l.TSIG.Secret}
+		}
+		started := make(chan struct{})
+		server.NotifyStartedFunc = func() { close(started) }
+		go func() { errs <- server.ListenAndServe() }()
+		select {
+		case <-started:
+			servers = append(servers, server)
+		case err := <-errs:
+			return err
+		}
+	}
+	select {
+	case <-ctx.Done():
+		return nil
+	case err := <-errs:
+		return err
+	}
+}
+
+// ServeDNS answers a NOTIFY and starts refreshing the registered requests
+// for the zone. Zones with no registered requests are refused.
+func (l *NotifyListener) ServeDNS(w dns.ResponseWriter, r *dns.Msg) {
+	m := new(dns.Msg)
+	switch {
+	case r.Opcode != dns.OpcodeNotify || len(r.Question) != 1:
+		m.SetRcode(r, dns.RcodeNotImplemented)
+	case l.TSIG != nil && (r.IsTsig() == nil || w.TsigStatus() != nil):
+		m.SetRcode(r, dns.RcodeNotAuth)
+	default:
+		m.SetReply(r)
+		m.Authoritative = true
+		if !l.notify(r.Question[0].Name) {
+			m.Rcode = dns.RcodeRefused
+		}
+	}
+	// Sign the answer with the key the NOTIFY was verified with
+	if tsig := r.IsTsig(); tsig != nil && w.TsigStatus() == nil {
+		m.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsigFudge, time.Now().Unix())
+	}
+	w.WriteMsg(m)
+}
+
+// Refreshes each request for a domain in zone, reporting whether there were any
+func (l *NotifyListener) notify(zone string) (found bool) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	for _, registration := range l.registrations {
+		if !registration.inZone(zone) {
+			continue
+		}
+		found = true
+		if registration.running {
+			registration.pending = true
+			continue
+		}
+		registration.running = true
+		go l.refresh(registration)
+	}
+	return
+}
+
+// Reports whether any name the request's domain can expand to with its search list is in zone
+func (registration *notifyRegistration) inZone(zone string) bool {
+	for _, name := range registration.req.searchNames() {
+		if dns.IsSubDomain(zone, dns.Fqdn(name)) {
+			return true
+		}
+	}
+	return false
+}
+
+// Refreshes the registered request until no NOTIFY arrived while it ran
+func (l *NotifyListener) refresh(registration *notifyRegistration) {
+	timeout := l.RefreshTimeout
+	if timeout <= 0 {
+		timeout = defaultNotifyRefreshTimeout
+	}
+	for {
+		if registration.req.Cache != nil {
+			registration.req.Cache.invalidate(registration.req)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		response, err := registration.req.GetContext(ctx)
+		cancel()
+		registration.fn(response, err)
+
+		l.mu.Lock()
+		if !registration.pending {
+			registration.running = false
+			l.mu.Unlock()
+			return
+		}
+		registration.pending = false
+		l.mu.Unlock()
+	}
+}
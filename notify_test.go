@@ -0,0 +1,232 @@
+package dta
+
+import (
+	"context"
+	"errors"
+	"net"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Sends a NOTIFY for zone to nameserver, signed with key if set
+func sendNotify(t *testing.T, nameserver NameServer, zone string, key *TSIGKey) *dns.Msg {
+	t.Helper()
+	m := new(dns.Msg)
+	m.SetNotify(zone)
+	c := new(dns.Client)
+	if key != nil {
+		m = signQuery(m, key)
+		c.TsigSecret = map[string]string{key.name(): key.Secret}
+	}
+	answer, _, err := c.Exchange(m, nameserver.address())
+	if err != nil {
+		t.Fatalf("Failed to send NOTIFY: %v", err)
+	}
+	return answer
+}
+
+// Waits for the next result passed to a registered callback
+func nextResult(t *testing.T, results <-chan Response) Response {
+	t.Helper()
+	select {
+	case res := <-results:
+		return res
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for refresh")
+	}
+	return Response{}
+}
+
+func TestNotifyRefreshesRequest(t *testing.T) {
+	var entries atomic.Value
+	entries.Store([]string{"color=blue"})
+	request := NewRequest("config.example.com", startServer(t, entriesHandler(&entries)))
+	request.Cache = NewCache(0, 0)
+	if _, err := request.Get(); err != nil {
+		t.Fatalf("Expected response, got: %v", err)
+	}
+
+	listener := NewNotifyListener("")
+	results := make(chan Response, 1)
+	listener.Register(request, func(res Response, err error) {
+		if err != nil {
+			t.Errorf("Expected refreshed response, got: %v", err)
+		}
+		results <- res
+	})
+	entries.Store([]string{"color=red"})
+	answer := sendNotify(t, startServer(t, listener.ServeDNS), "example.com.", nil)
+	if answer.Rcode != dns.RcodeSuccess || answer.Opcode != dns.OpcodeNotify || !answer.Authoritative {
+		t.Errorf("Expected authoritative NOTIFY answer, got %s", answer)
+	}
+	if res := nextResult(t, results); res.Config["color"] != "red" {
+		t.Errorf("Expected refreshed color=red, got %v", res.Config)
+	}
+	// The cache holds the refreshed response
+	if res, _ := request.Get(); res.Config["color"] != "red" {
+		t.Errorf("Expected cached color=red, got %v", res.Config)
+	}
+}
+
+func TestNotifyUnregisteredZone(t *testing.T) {
+	listener := NewNotifyListener("")
+	listener.Register(NewRequest("config.example.com"), func(Response, error) {
+		t.Errorf("Expected no refresh for another zone")
+	})
+	answer := sendNotify(t, startServer(t, listener.ServeDNS), "example.org.", nil)
+	if answer.Rcode != dns.RcodeRefused {
+		t.Errorf("Expected REFUSED, got %s", dns.RcodeToString[answer.Rcode])
+	}
+}
+
+func TestNotifyRejectsQueries(t *testing.T) {
+	listener := NewNotifyListener("")
+	m := new(dns.Msg)
+	m.SetQuestion("example.com.", dns.TypeSOA)
+	answer, err := dns.Exchange(m, startServer(t, listener.ServeDNS).address())
+	if err != nil {
+		t.Fatalf("Expected answer, got: %v", err)
+	}
+	if answer.Rcode != dns.RcodeNotImplemented {
+		t.Errorf("Expected NOTIMP, got %s", dns.RcodeToString[answer.Rcode])
+	}
+}
+
+func TestNotifyTSIG(t *testing.T) {
+	key := testTSIGKey
+	request := NewRequest("config.example.com", startServer(t, txtHandler("color=blue")))
+	listener := NewNotifyListener("")
+	listener.TSIG = key
+	results := make(chan Response, 1)
+	listener.Register(request, func(res Response, err error) { results <- res })
+	nameserver := startServerWith(t, func(server *dns.Server) {
+		server.TsigSecret = map[string]string{key.name(): key.Secret}
+	}, listener.ServeDNS)
+
+	if answer := sendNotify(t, nameserver, "example.com.", nil); answer.Rcode != dns.RcodeNotAuth {
+		t.Errorf("Expected NOTAUTH for unsigned NOTIFY, got %s", dns.RcodeToString[answer.Rcode])
+	}
+	wrong := &TSIGKey{Name: key.Name, Secret: "d3Jvbmcgc2VjcmV0IGZvciB0ZXN0aW5n"}
+	if answer := sendNotify(t, nameserver, "example.com.", wrong); answer.Rcode != dns.RcodeNotAuth {
+		t.Errorf("Expected NOTAUTH for badly signed NOTIFY, got %s", dns.RcodeToString[answer.Rcode])
+	}
+	select {
+	case <-results:
+		t.Fatal("Expected no refresh from unauthenticated NOTIFY")
+	default:
+	}
+
+	if answer := sendNotify(t, nameserver, "example.com.", key); answer.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected signed NOTIFY to succeed, got %s", dns.RcodeToString[answer.Rcode])
+	}
+	if res := nextResult(t, results); res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue, got %v", res.Config)
+	}
+}
+
+func TestNotifyListenAndServe(t *testing.T) {
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("Failed to find a free port: %v", err)
+	}
+	port := pc.LocalAddr().(*net.UDPAddr).Port
+	pc.Close()
+
+	listener := NewNotifyListener(net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	results := make(chan Response, 1)
+	listener.Register(NewRequest("example.com", startServer(t, txtHandler("color=blue"))), func(res Response, err error) { results <- res })
+	ctx, cancel := context.WithCancel(context.Background())
+	served := make(chan error, 1)
+	go func() { served <- listener.ListenAndServe(ctx) }()
+
+	// Wait for the listener to start answering
+	nameserver := NameServer{Host: "127.0.0.1", Port: port}
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		m := new(dns.Msg)
+		m.SetNotify("example.com.")
+		if _, err := dns.Exchange(m, nameserver.address()); err == nil {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for listener")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	nextResult(t, results)
+	cancel()
+	if err := <-served; err != nil {
+		t.Errorf("Expected nil after cancel, got: %v", err)
+	}
+}
+
+func TestNotifyCoalescesRefreshes(t *testing.T) {
+	var lookups atomic.Int32
+	release := make(chan struct{})
+	request := NewRequest("example.com", startServer(t, countingHandler(&lookups, func(w dns.ResponseWriter, r *dns.Msg) {
+		<-release
+		txtHandler("color=blue")(w, r)
+	})))
+	request.Timeout = 5 * time.Second
+	listener := NewNotifyListener("")
+	results := make(chan Response, 10)
+	listener.Register(request, func(res Response, err error) { results <- res })
+	nameserver := startServer(t, listener.ServeDNS)
+
+	sendNotify(t, nameserver, "example.com.", nil)
+	for lookups.Load() == 0 {
+		time.Sleep(5 * time.Millisecond)
+	}
+	// These arrive while the first refresh is running and are merged into one more
+	for i := 0; i < 5; i++ {
+		sendNotify(t, nameserver, "example.com.", nil)
+	}
+	close(release)
+	nextResult(t, results)
+	nextResult(t, results)
+	select {
+	case <-results:
+		t.Errorf("Expected NOTIFYs during a refresh to cause a single further refresh")
+	case <-time.After(200 * time.Millisecond):
+	}
+	if got := lookups.Load(); got != 2 {
+		t.Errorf("Expected 2 lookups, got %d", got)
+	}
+}
+
+func TestNotifyRefreshTimeout(t *testing.T) {
+	request := NewRequest("example.com", startBlackhole(t))
+	request.Timeout = 5 * time.Second
+	listener := NewNotifyListener("")
+	listener.RefreshTimeout = 100 * time.Millisecond
+	errs := make(chan error, 1)
+	listener.Register(request, func(_ Response, err error) { errs <- err })
+	sendNotify(t, startServer(t, listener.ServeDNS), "example.com.", nil)
+	select {
+	case err := <-errs:
+		if !errors.Is(err, ErrDeadlineExceeded) {
+			t.Errorf("Expected ErrDeadlineExceeded, got: %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for the refresh to be cut short")
+	}
+}
+
+func TestNotifySearchList(t *testing.T) {
+	request := NewRequest("config", startServer(t, zoneOnlyHandler("example.com.", txtHandler("color=blue"))))
+	request.Search = []string{"example.com"}
+	request.Ndots = 1
+	listener := NewNotifyListener("")
+	results := make(chan Response, 1)
+	listener.Register(request, func(res Response, err error) { results <- res })
+	if answer := sendNotify(t, startServer(t, listener.ServeDNS), "example.com.", nil); answer.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected NOTIFY for the search domain's zone to be accepted, got %s", dns.RcodeToString[answer.Rcode])
+	}
+	if res := nextResult(t, results); res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue, got %v", res.Config)
+	}
+}
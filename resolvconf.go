@@ -0,0 +1,64 @@
+package dta
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Where the system resolver configuration is read from by default
+const defaultResolvConf = "/etc/resolv.conf"
+
+// ResolvConf is a resolver configuration read from a resolv.conf format file
+type ResolvConf struct {
+	// NameServers are in the order listed, with Priority set to match
+	NameServers NameServers
+	// Search lists the domains appended to names with fewer than Ndots dots
+	Search []string
+	Ndots  int
+	// Timeout bounds the query to each nameserver
+	Timeout time.Duration
+	// Attempts is how many times each nameserver is tried
+	Attempts int
+}
+
+// ReadResolvConf reads the nameservers, search list and options from a
+// resolv.conf format file, defaulting to /etc/resolv.conf if path is empty
+func ReadResolvConf(path string) (conf ResolvConf, err error) {
+	if path == "" {
+		path = defaultResolvConf
+	}
+	config, err := dns.ClientConfigFromFile(path)
+	if err != nil {
+		return
+	}
+	port, err := strconv.Atoi(config.Port)
+	if err != nil {
+		return
+	}
+	for i, server := range config.Servers {
+		conf.NameServers = append(conf.NameServers, NameServer{Priority: i, Host: server, Port: port})
+	}
+	conf.Search = config.Search
+	conf.Ndots = config.Ndots
+	conf.Timeout = time.Duration(config.Timeout) * time.Second
+	conf.Attempts = config.Attempts
+	return
+}
+
+// NewRequestFromResolvConf returns a request for domain using the
+// nameservers and options in a resolv.conf format file, defaulting to
+// /etc/resolv.conf if path is empty
+func NewRequestFromResolvConf(domain, path string) (req request, err error) {
+	conf, err := ReadResolvConf(path)
+	if err != nil {
+		return
+	}
+	req = NewRequest(domain, conf.NameServers...)
+	req.Search = conf.Search
+	req.Ndots = conf.Ndots
+	req.Timeout = conf.Timeout
+	req.Attempts = conf.Attempts
+	return
+}
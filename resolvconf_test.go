@@ -0,0 +1,150 @@
+package dta
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const testResolvConf = `# generated for tests
+nameserver 192.0.2.1
+nameserver 2001:db8::1
+search corp.example.com example.com
+options ndots:2 timeout:3 attempts:4
+`
+
+func writeResolvConf(t *testing.T, content string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "resolv.conf")
+	if err := os.WriteFile(path, []byte(content), 0o644); err != nil {
+		t.Fatalf("Failed to write resolv.conf: %v", err)
+	}
+	return path
+}
+
+func TestReadResolvConf(t *testing.T) {
+	conf, err := ReadResolvConf(writeResolvConf(t, testResolvConf))
+	if err != nil {
+		t.Fatalf("Expected configuration, got: %v", err)
+	}
+	if len(conf.NameServers) != 2 || conf.NameServers[0].Host != "192.0.2.1" || conf.NameServers[1].Host != "2001:db8::1" {
+		t.Errorf("Expected both nameservers in order, got %+v", conf.NameServers)
+	}
+	if conf.NameServers[0].Port != 53 || conf.NameServers[0].Priority >= conf.NameServers[1].Priority {
+		t.Errorf("Expected port 53 and increasing priorities, got %+v", conf.NameServers)
+	}
+	if len(conf.Search) != 2 || conf.Search[0] != "corp.example.com" {
+		t.Errorf("Expected search list, got %v", conf.Search)
+	}
+	if conf.Ndots != 2 || conf.Timeout != 3*time.Second || conf.Attempts != 4 {
+		t.Errorf("Expected ndots 2, timeout 3s and 4 attempts, got %d, %s and %d", conf.Ndots, conf.Timeout, conf.Attempts)
+	}
+}
+
+func TestReadResolvConfMissing(t *testing.T) {
+	if _, err := ReadResolvConf(filepath.Join(t.TempDir(), "missing")); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected file not found, got: %v", err)
+	}
+}
+
+func TestNewRequestFromResolvConf(t *testing.T) {
+	request, err := NewRequestFromResolvConf("config", writeResolvConf(t, testResolvConf))
+	if err != nil {
+		t.Fatalf("Expected request, got: %v", err)
+	}
+	if request.Domain != "config" || len(request.NameServers) != 2 || request.Timeout != 3*time.Second ||
+		request.Attempts != 4 || request.Ndots != 2 || len(request.Search) != 2 {
+		t.Errorf("Expected request configured from resolv.conf, got %+v", request)
+	}
+}
+
+func TestSearchNames(t *testing.T) {
+	tests := []struct {
+		domain   string
+		ndots    int
+		expected []string
+	}{
+		{"config", 1, []string{"config.corp.example.com.", "config.example.com.", "config"}},
+		{"config.app", 1, []string{"config.app", "config.app.corp.example.com.", "config.app.example.com."}},
+		{"config.app", 2, []string{"config.app.corp.example.com.", "config.app.example.com.", "config.app"}},
+		{"config.example.com.", 5, []string{"config.example.com."}},
+	}
+	for _, test := range tests {
+		request := NewRequest(test.domain)
+		request.Search = []string{"corp.example.com", "example.com."}
+		request.Ndots = test.ndots
+		got := request.searchNames()
+		if len(got) != len(test.expected) {
+			t.Errorf("Expected %v for %s, got %v", test.expected, test.domain, got)
+			continue
+		}
+		for i := range got {
+			if got[i] != test.expected[i] {
+				t.Errorf("Expected %v for %s, got %v", test.expected, test.domain, got)
+				break
+			}
+		}
+	}
+}
+
+func TestSearchList(t *testing.T) {
+	request := NewRequest("config", startServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Name == "config.example.com." {
+			txtHandler("color=blue")(w, r)
+			return
+		}
+		nxdomainHandler(nil)(w, r)
+	}))
+	request.Search = []string{"corp.example.com", "example.com"}
+	request.Ndots = 1
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Expected response from the second search domain, got: %v", err)
+	}
+	if res.Config["color"] != "blue" || res.Msg.Question[0].Name != "config.example.com." {
+		t.Errorf("Expected color=blue for config.example.com, got %v for %v", res.Config, res.Msg.Question)
+	}
+
+	request.Search = []string{"corp.example.com"}
+	if _, err = request.Get(); !errors.Is(err, ErrNXDOMAIN) {
+		t.Errorf("Expected NXDOMAIN once every name is tried, got: %v", err)
+	}
+}
+
+func TestAttempts(t *testing.T) {
+	var queries atomic.Int32
+	// Drops the first query, as if the packet were lost
+	request := NewRequest("example.com", startServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if queries.Add(1) > 1 {
+			txtHandler("color=blue")(w, r)
+		}
+	}))
+	request.Timeout = 100 * time.Millisecond
+	if _, err := request.Get(); !errors.Is(err, ErrTimeout) {
+		t.Fatalf("Expected timeout with a single attempt, got: %v", err)
+	}
+
+	queries.Store(0)
+	request.Attempts = 2
+	res, err := request.Get()
+	if err != nil || res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue on the second attempt, got %v, %v", res.Config, err)
+	}
+}
+
+func TestAttemptsNotForAnswers(t *testing.T) {
+	var queries atomic.Int32
+	request := NewRequest("example.com", startServer(t, countingHandler(&queries, rcodeHandler(dns.RcodeServerFailure))))
+	request.Attempts = 3
+	_, err := request.Get()
+	var lookupErr *LookupError
+	if !errors.As(err, &lookupErr) || len(lookupErr.Errors) != 1 || queries.Load() != 1 {
+		t.Errorf("Expected one query when the nameserver answers, got %d queries and: %v", queries.Load(), err)
+	}
+}
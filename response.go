@@ -0,0 +1,63 @@
+package dta
+
+import "strings"
+
+// Attribute returns the named attribute with the spelling used in DNS.
+// Names are matched case-insensitively as required by RFC 1464. If
+// several attributes differ only in case, an exact match is preferred,
+// otherwise the name that sorts first is returned.
+func (r Response) Attribute(name string) (attribute Attribute, ok bool) {
+	if value, exact := r.Config[name]; exact {
+		return Attribute{Name: name, Value: value}, true
+	}
+	for n, v := range r.Config {
+		if strings.EqualFold(n, name) && (!ok || n < attribute.Name) {
+			attribute, ok = Attribute{Name: n, Value: v}, true
+		}
+	}
+	return
+}
+
+// Values returns every value of the named attribute in Attributes order,
+// matching the name case-insensitively
+func (r Response) Values(name string) (values []string) {
+	for _, attribute := range r.Attributes {
+		if strings.EqualFold(attribute.Name, name) {
+			values = append(values, attribute.Value)
+		}
+	}
+	return
+}
+
+// Get returns the value of the named attribute, matching the name case-insensitively
+func (r Response) Get(name string) (value string, ok bool) {
+	attribute, ok := r.Attribute(name)
+	return attribute.Value, ok
+}
+
+// Orders attributes by name ignoring case, then by name and value
+func attributeLess(a, b Attribute) bool {
+	if lowerA, lowerB := strings.ToLower(a.Name), strings.ToLower(b.Name); lowerA != lowerB {
+		return lowerA < lowerB
+	}
+	if a.Name != b.Name {
+		return a.Name < b.Name
+	}
+	return a.Value < b.Value
+}
+
+// Returns an error for the first attribute name that appears more
+// than once, expecting attributes in attributeLess order
+func checkDuplicates(attributes []Attribute) error {
+	for i := 0; i+1 < len(attributes); i++ {
+		if !strings.EqualFold(attributes[i].Name, attributes[i+1].Name) {
+			continue
+		}
+		dup := &DuplicateAttributeError{Name: attributes[i].Name}
+		for j := i; j < len(attributes) && strings.EqualFold(attributes[j].Name, dup.Name); j++ {
+			dup.Values = append(dup.Values, attributes[j].Value)
+		}
+		return dup
+	}
+	return nil
+}
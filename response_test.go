@@ -0,0 +1,179 @@
+package dta
+
+import (
+	"errors"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestResponseGetCaseInsensitive(t *testing.T) {
+	res := Response{Config: map[string]string{"Color": "blue"}}
+	for _, name := range []string{"Color", "color", "COLOR"} {
+		if value, ok := res.Get(name); !ok || value != "blue" {
+			t.Errorf("Expected %s to match Color=blue, got %q, %v", name, value, ok)
+		}
+	}
+	if _, ok := res.Get("colour"); ok {
+		t.Errorf("Expected no match for colour")
+	}
+}
+
+func TestResponseAttributePreservesSpelling(t *testing.T) {
+	res := Response{Config: map[string]string{"TimeOut": "30"}}
+	attribute, ok := res.Attribute("timeout")
+	if !ok || attribute.Name != "TimeOut" || attribute.Value != "30" {
+		t.Errorf("Expected TimeOut=30, got %+v, %v", attribute, ok)
+	}
+}
+
+func TestResponseGetCaseConflict(t *testing.T) {
+	res := Response{Config: map[string]string{"color": "red", "Color": "blue", "COLOR": "green"}}
+	// An exact match wins
+	for name, expected := range map[string]string{"color": "red", "Color": "blue", "COLOR": "green"} {
+		if value, _ := res.Get(name); value != expected {
+			t.Errorf("Expected %s=%s, got %s", name, expected, value)
+		}
+	}
+	// Otherwise the name that sorts first
+	for i := 0; i < 10; i++ {
+		attribute, _ := res.Attribute("coLor")
+		if attribute.Name != "COLOR" || attribute.Value != "green" {
+			t.Errorf("Expected COLOR=green, got %+v", attribute)
+		}
+	}
+}
+
+func TestProcessRecordKeepsDuplicates(t *testing.T) {
+	res := processRecord(processRecordMsg("server=b", "Server=c", "server=a", "color=blue"))
+	expected := []Attribute{
+		{Name: "color", Value: "blue", TTL: 300},
+		{Name: "Server", Value: "c", TTL: 300},
+		{Name: "server", Value: "a", TTL: 300},
+		{Name: "server", Value: "b", TTL: 300},
+	}
+	if !reflect.DeepEqual(res.Attributes, expected) {
+		t.Errorf("Expected attributes %v, got %v", expected, res.Attributes)
+	}
+	if values := res.Values("SERVER"); !reflect.DeepEqual(values, []string{"c", "a", "b"}) {
+		t.Errorf("Expected values [c a b], got %v", values)
+	}
+	if res.Config["server"] != "a" || res.Config["Server"] != "c" {
+		t.Errorf("Expected first value of each name in Config, got %v", res.Config)
+	}
+	if values := res.Values("missing"); values != nil {
+		t.Errorf("Expected no values, got %v", values)
+	}
+}
+
+func TestProcessRecordOrderIsStable(t *testing.T) {
+	entries := []string{"b=2", "a=1", "a=0", "B=3"}
+	var first []Attribute
+	for i := 0; i < len(entries); i++ {
+		// Rotate the RRset to simulate resolvers shuffling it
+		rotated := append(append([]string{}, entries[i:]...), entries[:i]...)
+		res := processRecord(processRecordMsg(rotated...))
+		if first == nil {
+			first = res.Attributes
+		} else if !reflect.DeepEqual(first, res.Attributes) {
+			t.Errorf("Expected order %v, got %v", first, res.Attributes)
+		}
+	}
+}
+
+// Builds a TXT answer for test.com. with one record per entry
+func processRecordMsg(entries ...string) *dns.Msg {
+	msg := new(dns.Msg)
+	msg.SetQuestion("test.com.", dns.TypeTXT)
+	for _, entry := range entries {
+		msg.Answer = append(msg.Answer, &dns.TXT{
+			Hdr: dns.RR_Header{Name: "test.com.", Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: 300},
+			Txt: []string{entry},
+		})
+	}
+	return msg
+}
+
+func TestStrictDuplicates(t *testing.T) {
+	request := NewRequest("example.com", startServer(t, txtHandler("color=blue", "Color=red", "size=1")))
+	if _, err := request.Get(); err != nil {
+		t.Fatalf("Unexpected error without strict mode: %v", err)
+	}
+	request.StrictDuplicates = true
+	res, err := request.Get()
+	if !errors.Is(err, ErrDuplicateAttribute) {
+		t.Fatalf("Expected ErrDuplicateAttribute, got: %v", err)
+	}
+	var dupErr *DuplicateAttributeError
+	if !errors.As(err, &dupErr) || !strings.EqualFold(dupErr.Name, "color") || len(dupErr.Values) != 2 {
+		t.Errorf("Expected both values of color in error, got: %+v", dupErr)
+	}
+	if len(res.Config) != 0 {
+		t.Errorf("Expected no config on error, got %v", res.Config)
+	}
+
+	request = NewRequest("example.com", startServer(t, txtHandler("color=blue", "size=1")))
+	request.StrictDuplicates = true
+	if _, err := request.Get(); err != nil {
+		t.Errorf("Unexpected error without duplicates: %v", err)
+	}
+}
+
+func TestResponseMetadata(t *testing.T) {
+	nameserver1 := startServer(t, rcodeHandler(dns.RcodeServerFailure))
+	nameserver2 := startServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		m.Authoritative = true
+		m.RecursionAvailable = true
+		for i, entry := range []string{"color=blue", "size=1"} {
+			m.Answer = append(m.Answer, &dns.TXT{
+				Hdr: dns.RR_Header{Name: r.Question[0].Name, Rrtype: dns.TypeTXT, Class: dns.ClassINET, Ttl: uint32(300 - i*60)},
+				Txt: []string{entry},
+			})
+		}
+		w.WriteMsg(m)
+	})
+	nameserver2.Priority = 1
+	res, err := NewRequest("example.com", nameserver1, nameserver2).Get()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if res.NameServer.Port != nameserver2.Port {
+		t.Errorf("Expected answer from %s, got %s", nameserver2.address(), res.NameServer.address())
+	}
+	if res.RTT <= 0 {
+		t.Errorf("Expected a round trip time, got %s", res.RTT)
+	}
+	if res.TTL != 240 {
+		t.Errorf("Expected lowest TTL 240, got %d", res.TTL)
+	}
+	for _, attribute := range res.Attributes {
+		if expected := map[string]uint32{"color": 300, "size": 240}[attribute.Name]; attribute.TTL != expected {
+			t.Errorf("Expected %s TTL %d, got %d", attribute.Name, expected, attribute.TTL)
+		}
+	}
+	if !res.Authoritative || !res.RecursionAvailable || res.AuthenticatedData {
+		t.Errorf("Expected AA and RA flags only, got %+v", res)
+	}
+	if res.Rcode != dns.RcodeSuccess {
+		t.Errorf("Expected NOERROR, got %s", dns.RcodeToString[res.Rcode])
+	}
+	if res.Msg == nil || len(res.Msg.Answer) != 2 {
+		t.Errorf("Expected the raw answer, got %v", res.Msg)
+	}
+}
+
+func TestResponseTTLIncludesCNAME(t *testing.T) {
+	msg := processRecordMsg("color=blue")
+	msg.Question[0].Name = "alias.test.com."
+	msg.Answer = append(msg.Answer, &dns.CNAME{
+		Hdr:    dns.RR_Header{Name: "alias.test.com.", Rrtype: dns.TypeCNAME, Class: dns.ClassINET, Ttl: 60},
+		Target: "test.com.",
+	})
+	if res := processRecord(msg); res.TTL != 60 {
+		t.Errorf("Expected CNAME TTL 60, got %d", res.TTL)
+	}
+}
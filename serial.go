@@ -0,0 +1,73 @@
+package dta
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// ErrNoSOA is returned when the zone's serial is needed but the answer has no SOA record
+var ErrNoSOA = errors.New("no SOA record in answer")
+
+// Refresh checks the zone's SOA serial and returns prev unchanged if it
+// matches prev.Serial, otherwise it looks the domain up again. As with
+// lookups, each name from the search list is tried in turn. refreshed
+// reports whether the TXT records were fetched. Refresh always queries
+// the nameservers, bypassing Cache.
+func (req request) Refresh(ctx context.Context, prev Response) (response Response, refreshed bool, err error) {
+	if req.TotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, req.TotalTimeout)
+		defer cancel()
+	}
+	err = req.eachName(func(candidate request) (err error) {
+		response, refreshed, err = candidate.refreshName(ctx, prev)
+		return
+	})
+	return
+}
+
+// Refreshes the request's domain without applying the search list
+func (req request) refreshName(ctx context.Context, prev Response) (response Response, refreshed bool, err error) {
+	source := req
+	if req.Authoritative {
+		if source, err = req.authoritativeRequest(ctx); err != nil {
+			return
+		}
+	}
+	serial, err := zoneSerial(ctx, source)
+	if err != nil {
+		return
+	}
+	// The serial only says prev is current if it was for the same name
+	samePrev := prev.Msg == nil || len(prev.Msg.Question) == 0 ||
+		strings.EqualFold(prev.Msg.Question[0].Name, dns.Fqdn(req.Domain))
+	if prev.Serial != 0 && serial == prev.Serial && samePrev {
+		return prev, false, nil
+	}
+	// Fetched from the nameservers whose serial was just checked
+	if response, err = req.fetch(ctx, source); err != nil {
+		return
+	}
+	response.Serial = serial
+	return response, true, nil
+}
+
+// Returns the serial of the zone containing the request's domain. A query
+// for a name below the zone apex has the SOA in the authority section.
+func zoneSerial(ctx context.Context, req request) (serial uint32, err error) {
+	record, _, _, err := query(ctx, req, newQuery(req, req.Domain, dns.TypeSOA))
+	if err != nil {
+		return
+	}
+	for _, rrs := range [][]dns.RR{record.Answer, record.Ns} {
+		for _, rr := range rrs {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return soa.Serial, nil
+			}
+		}
+	}
+	return 0, ErrNoSOA
+}
@@ -0,0 +1,237 @@
+package dta
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Returns a handler for zone answering SOA queries with the current serial
+// and TXT queries with the current entries, counting the TXT queries
+func serialHandler(zone string, serial *atomic.Uint32, entries *atomic.Value, txtQueries *atomic.Int32) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Qtype == dns.TypeTXT {
+			txtQueries.Add(1)
+			txtHandler(entries.Load().([]string)...)(w, r)
+			return
+		}
+		m := new(dns.Msg)
+		m.SetReply(r)
+		soa := &dns.SOA{
+			Hdr:    dns.RR_Header{Name: zone, Rrtype: dns.TypeSOA, Class: dns.ClassINET, Ttl: 300},
+			Ns:     "ns1." + zone,
+			Mbox:   "hostmaster." + zone,
+			Serial: serial.Load(),
+			Minttl: 60,
+		}
+		if r.Question[0].Name == zone {
+			m.Answer = append(m.Answer, soa)
+		} else {
+			m.Ns = append(m.Ns, soa)
+		}
+		w.WriteMsg(m)
+	}
+}
+
+func TestRefreshSkipsUnchangedSerial(t *testing.T) {
+	var serial atomic.Uint32
+	var entries atomic.Value
+	var txtQueries atomic.Int32
+	serial.Store(2024010101)
+	entries.Store([]string{"color=blue"})
+	request := NewRequest("example.com", startServer(t, serialHandler("example.com.", &serial, &entries, &txtQueries)))
+	request.CheckSerial = true
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Expected response, got: %v", err)
+	}
+	if res.Serial != 2024010101 {
+		t.Errorf("Expected serial 2024010101, got %d", res.Serial)
+	}
+
+	entries.Store([]string{"color=red"})
+	res, refreshed, err := request.Refresh(context.Background(), res)
+	if err != nil || refreshed {
+		t.Fatalf("Expected no refresh with unchanged serial, got %v, %v", refreshed, err)
+	}
+	if res.Config["color"] != "blue" || txtQueries.Load() != 1 {
+		t.Errorf("Expected previous color=blue and one TXT query, got %v and %d", res.Config, txtQueries.Load())
+	}
+
+	serial.Store(2024010102)
+	res, refreshed, err = request.Refresh(context.Background(), res)
+	if err != nil || !refreshed {
+		t.Fatalf("Expected refresh after serial change, got %v, %v", refreshed, err)
+	}
+	if res.Config["color"] != "red" || res.Serial != 2024010102 {
+		t.Errorf("Expected color=red with serial 2024010102, got %v with %d", res.Config, res.Serial)
+	}
+}
+
+func TestRefreshBelowZoneApex(t *testing.T) {
+	var serial atomic.Uint32
+	var entries atomic.Value
+	var txtQueries atomic.Int32
+	serial.Store(7)
+	entries.Store([]string{"color=blue"})
+	request := NewRequest("config.example.com", startServer(t, serialHandler("example.com.", &serial, &entries, &txtQueries)))
+	// Without a previous serial the records are always fetched
+	res, refreshed, err := request.Refresh(context.Background(), Response{})
+	if err != nil || !refreshed {
+		t.Fatalf("Expected refresh, got %v, %v", refreshed, err)
+	}
+	if res.Serial != 7 || res.Config["color"] != "blue" {
+		t.Errorf("Expected serial 7 from the authority section with color=blue, got %d and %v", res.Serial, res.Config)
+	}
+}
+
+func TestRefreshNoSOA(t *testing.T) {
+	request := NewRequest("example.com", startServer(t, txtHandler("color=blue")))
+	request.CheckSerial = true
+	if _, err := request.Get(); !errors.Is(err, ErrNoSOA) {
+		t.Errorf("Expected ErrNoSOA, got: %v", err)
+	}
+}
+
+func TestWatchCheckSerial(t *testing.T) {
+	var serial atomic.Uint32
+	var entries atomic.Value
+	var txtQueries atomic.Int32
+	serial.Store(1)
+	entries.Store([]string{"color=blue"})
+	request := NewRequest("example.com", startServer(t, serialHandler("example.com.", &serial, &entries, &txtQueries)))
+	request.CheckSerial = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := request.Watch(ctx, 10*time.Millisecond)
+	nextChange(t, changes)
+
+	// Unpublished changes aren't fetched until the serial changes
+	entries.Store([]string{"color=red"})
+	time.Sleep(50 * time.Millisecond)
+	if got := txtQueries.Load(); got != 1 {
+		t.Errorf("Expected one TXT query while the serial is unchanged, got %d", got)
+	}
+	serial.Store(2)
+	if change := nextChange(t, changes); change.Type != ChangeModified || change.Response.Serial != 2 {
+		t.Errorf("Expected color modified at serial 2, got %s at %d", change.Type, change.Response.Serial)
+	}
+}
+
+// Like serialHandler but answers NXDOMAIN for names outside zone
+func zoneOnlyHandler(zone string, handler dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		if !dns.IsSubDomain(zone, r.Question[0].Name) {
+			nxdomainHandler(nil)(w, r)
+			return
+		}
+		handler(w, r)
+	}
+}
+
+func TestRefreshSearchList(t *testing.T) {
+	var serial atomic.Uint32
+	var entries atomic.Value
+	var txtQueries atomic.Int32
+	serial.Store(5)
+	entries.Store([]string{"color=blue"})
+	handler := zoneOnlyHandler("example.com.", serialHandler("example.com.", &serial, &entries, &txtQueries))
+	request := NewRequest("config", startServer(t, handler))
+	request.Search = []string{"corp.example.org", "example.com"}
+	request.Ndots = 1
+	request.CheckSerial = true
+	res, err := request.Get()
+	if err != nil || res.Serial != 5 {
+		t.Fatalf("Expected response with serial 5, got %d, %v", res.Serial, err)
+	}
+
+	res, refreshed, err := request.Refresh(context.Background(), res)
+	if err != nil || refreshed {
+		t.Fatalf("Expected no refresh with unchanged serial, got %v, %v", refreshed, err)
+	}
+	serial.Store(6)
+	entries.Store([]string{"color=red"})
+	res, refreshed, err = request.Refresh(context.Background(), res)
+	if err != nil || !refreshed {
+		t.Fatalf("Expected refresh after serial change, got %v, %v", refreshed, err)
+	}
+	if res.Config["color"] != "red" || res.Serial != 6 || res.Msg.Question[0].Name != "config.example.com." {
+		t.Errorf("Expected color=red for config.example.com at serial 6, got %v for %v at %d", res.Config, res.Msg.Question, res.Serial)
+	}
+}
+
+func TestWatchCheckSerialSearchList(t *testing.T) {
+	var serial atomic.Uint32
+	var entries atomic.Value
+	var txtQueries atomic.Int32
+	serial.Store(1)
+	entries.Store([]string{"color=blue"})
+	handler := zoneOnlyHandler("example.com.", serialHandler("example.com.", &serial, &entries, &txtQueries))
+	request := NewRequest("config", startServer(t, handler))
+	request.Search = []string{"example.com"}
+	request.Ndots = 1
+	request.CheckSerial = true
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := request.Watch(ctx, 10*time.Millisecond)
+	nextChange(t, changes)
+	entries.Store([]string{"color=red"})
+	serial.Store(2)
+	if change := nextChange(t, changes); change.Type != ChangeModified || change.Response.Serial != 2 {
+		t.Errorf("Expected color modified at serial 2, got %s at %d", change.Type, change.Response.Serial)
+	}
+}
+
+// Sets the AA bit on every answer written, as an authoritative nameserver would
+type authoritativeWriter struct {
+	dns.ResponseWriter
+}
+
+func (w authoritativeWriter) WriteMsg(m *dns.Msg) error {
+	m.Authoritative = true
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func TestRefreshAuthoritativeResolvesOnce(t *testing.T) {
+	var serial atomic.Uint32
+	var entries atomic.Value
+	var txtQueries, nsQueries atomic.Int32
+	serial.Store(1)
+	entries.Store([]string{"color=blue"})
+	zone := serialHandler("example.com.", &serial, &entries, &txtQueries)
+	authoritative := startServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		zone(authoritativeWriter{w}, r)
+	})
+	bootstrap := bootstrapHandler(false)
+	request := NewRequest("config.example.com", startServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		if r.Question[0].Qtype == dns.TypeNS {
+			nsQueries.Add(1)
+		}
+		bootstrap(w, r)
+	}))
+	request.Authoritative = true
+	request.AuthoritativePort = authoritative.Port
+	request.CheckSerial = true
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Expected response, got: %v", err)
+	}
+	perLookup := nsQueries.Load()
+
+	serial.Store(2)
+	entries.Store([]string{"color=red"})
+	res, refreshed, err := request.Refresh(context.Background(), res)
+	if err != nil || !refreshed {
+		t.Fatalf("Expected refresh after serial change, got %v, %v", refreshed, err)
+	}
+	if res.Config["color"] != "red" || res.NameServer.Port != authoritative.Port {
+		t.Errorf("Expected color=red from the authoritative nameserver, got %v from %+v", res.Config, res.NameServer)
+	}
+	if got := nsQueries.Load(); got != 2*perLookup {
+		t.Errorf("Expected the nameservers to be resolved once per refresh, got %d NS queries after %d for the lookup", got, perLookup)
+	}
+}
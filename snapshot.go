@@ -0,0 +1,238 @@
+package dta
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// ErrSnapshotCorrupt is returned when the snapshot file can't be parsed
+var ErrSnapshotCorrupt = errors.New("snapshot file is corrupt")
+
+// SnapshotStore keeps the last successful response for each domain in a
+// file so it can be served when no nameserver answers and nothing is
+// cached, such as on a cold start during an outage. Lookups don't fail
+// because the file can't be used, so check LastError to find out. A
+// SnapshotStore is safe for concurrent use and can be shared between requests.
+type SnapshotStore struct {
+	// Path is the file snapshots are written to
+	Path string
+	// MaxAge is how old a snapshot can be and still be served. Zero means no limit.
+	MaxAge time.Duration
+
+	mu sync.Mutex
+	// Fetch time of the last response saved for each domain
+	saved   map[string]time.Time
+	lastErr error
+	now     func() time.Time
+}
+
+// Snapshot is a response as stored on disk
+type Snapshot struct {
+	Attributes []Attribute `json:"attributes"`
+	// Fetched is when the response was received
+	Fetched time.Time `json:"fetched"`
+	// TTL is the response's lowest record TTL in seconds
+	TTL    uint32 `json:"ttl"`
+	Secure bool   `json:"secure,omitempty"`
+	// NameServer is the endpoint that gave the response
+	NameServer snapshotServer `json:"nameserver"`
+}
+
+// The parts of a NameServer that identify it, leaving out keys and clients
+type snapshotServer struct {
+	Host      string    `json:"host,omitempty"`
+	Port      int       `json:"port,omitempty"`
+	Transport Transport `json:"transport,omitempty"`
+	URL       string    `json:"url,omitempty"`
+}
+
+// NewSnapshotStore returns a store writing to path that serves snapshots up to maxAge old
+func NewSnapshotStore(path string, maxAge time.Duration) *SnapshotStore {
+	return &SnapshotStore{Path: path, MaxAge: maxAge}
+}
+
+func (s *SnapshotStore) clock() time.Time {
+	if s.now != nil {
+		return s.now()
+	}
+	return time.Now()
+}
+
+// Load returns the stored snapshot for domain, ignoring its age
+func (s *SnapshotStore) Load(domain string) (snapshot Snapshot, ok bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	snapshots, err := s.read()
+	if err != nil {
+		return
+	}
+	snapshot, ok = snapshots[snapshotKey(domain)]
+	return
+}
+
+// LastError returns the error from the last time a lookup read or wrote
+// the file, or nil if that succeeded
+func (s *SnapshotStore) LastError() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.lastErr
+}
+
+// Save stores response as the snapshot for domain. A file that can't be
+// parsed is moved aside to Path with ".corrupt" appended and replaced.
+func (s *SnapshotStore) Save(domain string, response Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.save(domain, response)
+}
+
+func (s *SnapshotStore) save(domain string, response Response) error {
+	snapshots, err := s.read()
+	if errors.Is(err, ErrSnapshotCorrupt) {
+		// Keep the file for inspection rather than failing every save
+		if err = os.Rename(s.Path, s.Path+".corrupt"); err != nil {
+			return err
+		}
+	}
+	if err != nil {
+		return err
+	}
+	if snapshots == nil {
+		snapshots = make(map[string]Snapshot)
+	}
+	key := snapshotKey(domain)
+	snapshots[key] = Snapshot{
+		Attributes: response.Attributes,
+		Fetched:    response.Fetched,
+		TTL:        response.TTL,
+		Secure:     response.Secure,
+		NameServer: snapshotServer{
+			Host:      response.NameServer.Host,
+			Port:      response.NameServer.Port,
+			Transport: response.NameServer.Transport,
+			URL:       response.NameServer.URL,
+		},
+	}
+	if err = s.write(snapshots); err != nil {
+		return err
+	}
+	if s.saved == nil {
+		s.saved = make(map[string]time.Time)
+	}
+	s.saved[key] = response.Fetched
+	return nil
+}
+
+// Reads every snapshot in the file, returning none if it doesn't exist yet
+func (s *SnapshotStore) read() (snapshots map[string]Snapshot, err error) {
+	data, err := os.ReadFile(s.Path)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return
+	}
+	if err = json.Unmarshal(data, &snapshots); err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrSnapshotCorrupt, err)
+	}
+	return
+}
+
+// Replaces the file with snapshots. The data is written to a temporary file
+// that's renamed over the original so readers never see a partial write.
+func (s *SnapshotStore) write(snapshots map[string]Snapshot) (err error) {
+	data, err := json.MarshalIndent(snapshots, "", "  ")
+	if err != nil {
+		return
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(s.Path), filepath.Base(s.Path)+".*.tmp")
+	if err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+	if _, err = tmp.Write(data); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Sync(); err != nil {
+		tmp.Close()
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	return os.Rename(tmp.Name(), s.Path)
+}
+
+// Saves a newly fetched response, or when no nameserver answered falls
+// back to the stored snapshot if it's recent enough. A failure to save doesn't fail
+// the lookup as the response itself is still good.
+func (s *SnapshotStore) apply(req request, response Response, err error) (Response, error) {
+	key := snapshotKey(req.Domain)
+	if err == nil {
+		s.mu.Lock()
+		defer s.mu.Unlock()
+		// Cached and stale responses have already been saved
+		if !response.Stale && response.Fetched.After(s.saved[key]) {
+			s.lastErr = s.save(req.Domain, response)
+		}
+		return response, nil
+	}
+	if !unreachable(err) {
+		return response, err
+	}
+	s.mu.Lock()
+	snapshots, loadErr := s.read()
+	s.lastErr = loadErr
+	s.mu.Unlock()
+	snapshot, ok := snapshots[key]
+	if !ok {
+		return response, err
+	}
+	if s.MaxAge > 0 && s.clock().Sub(snapshot.Fetched) > s.MaxAge {
+		return response, err
+	}
+	if req.ValidateDNSSEC && !snapshot.Secure {
+		return response, err
+	}
+	return snapshot.response(), nil
+}
+
+// Returns the snapshot as a stale response
+func (snapshot Snapshot) response() (response Response) {
+	response.Attributes = snapshot.Attributes
+	response.Config = make(map[string]string, len(snapshot.Attributes))
+	for _, attribute := range snapshot.Attributes {
+		if _, ok := response.Config[attribute.Name]; !ok {
+			response.Config[attribute.Name] = attribute.Value
+		}
+	}
+	response.Fetched = snapshot.Fetched
+	response.TTL = snapshot.TTL
+	response.Secure = snapshot.Secure
+	response.NameServer = NameServer{
+		Host:      snapshot.NameServer.Host,
+		Port:      snapshot.NameServer.Port,
+		Transport: snapshot.NameServer.Transport,
+		URL:       snapshot.NameServer.URL,
+	}
+	response.Stale = true
+	return
+}
+
+func snapshotKey(domain string) string {
+	return strings.ToLower(dns.Fqdn(domain))
+}
@@ -0,0 +1,153 @@
+package dta
+
+import (
+	"errors"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func TestSnapshotServedOnFailure(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshots.json")
+	good := startServer(t, ttlHandler(60, "color=blue"))
+	request := NewRequest("example.com", good)
+	request.Snapshots = NewSnapshotStore(path, time.Hour)
+	fresh, err := request.Get()
+	if err != nil {
+		t.Fatalf("Expected fresh response, got: %v", err)
+	}
+
+	// A new store, as after a restart, with every nameserver failing
+	request = NewRequest("example.com", startServer(t, rcodeHandler(dns.RcodeServerFailure)))
+	request.Snapshots = NewSnapshotStore(path, time.Hour)
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Expected snapshot instead of error, got: %v", err)
+	}
+	if !res.Stale || res.Config["color"] != "blue" {
+		t.Errorf("Expected stale color=blue, got %+v", res)
+	}
+	if !res.Fetched.Equal(fresh.Fetched) || res.TTL != 60 {
+		t.Errorf("Expected fetch time %s and TTL 60, got %s and %d", fresh.Fetched, res.Fetched, res.TTL)
+	}
+	if res.NameServer.Host != good.Host || res.NameServer.Port != good.Port {
+		t.Errorf("Expected source %s:%d, got %+v", good.Host, good.Port, res.NameServer)
+	}
+}
+
+func TestSnapshotTooOld(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshots.json")
+	request := NewRequest("example.com", startServer(t, ttlHandler(60, "color=blue")))
+	request.Snapshots = NewSnapshotStore(path, time.Hour)
+	request.Get()
+
+	request = NewRequest("example.com", startServer(t, rcodeHandler(dns.RcodeServerFailure)))
+	request.Snapshots = NewSnapshotStore(path, time.Hour)
+	request.Snapshots.now = func() time.Time { return time.Now().Add(2 * time.Hour) }
+	if _, err := request.Get(); !errors.Is(err, ErrSERVFAIL) {
+		t.Errorf("Expected SERVFAIL with a snapshot past MaxAge, got: %v", err)
+	}
+}
+
+func TestSnapshotNotForNXDOMAIN(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshots.json")
+	request := NewRequest("example.com", startServer(t, ttlHandler(60, "color=blue")))
+	request.Snapshots = NewSnapshotStore(path, 0)
+	request.Get()
+
+	request = NewRequest("example.com", startServer(t, nxdomainHandler(nil)))
+	request.Snapshots = NewSnapshotStore(path, 0)
+	if _, err := request.Get(); !errors.Is(err, ErrNXDOMAIN) {
+		t.Errorf("Expected NXDOMAIN rather than a snapshot, got: %v", err)
+	}
+}
+
+func TestSnapshotNotForStrictDuplicates(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshots.json")
+	request := NewRequest("example.com", startServer(t, txtHandler("color=blue")))
+	request.Snapshots = NewSnapshotStore(path, 0)
+	request.Get()
+
+	request = NewRequest("example.com", startServer(t, txtHandler("color=blue", "color=red")))
+	request.Snapshots = NewSnapshotStore(path, 0)
+	request.StrictDuplicates = true
+	if res, err := request.Get(); !errors.Is(err, ErrDuplicateAttribute) {
+		t.Errorf("Expected ErrDuplicateAttribute rather than a snapshot, got %+v, %v", res, err)
+	}
+}
+
+func TestSnapshotPerDomain(t *testing.T) {
+	dir := t.TempDir()
+	store := NewSnapshotStore(filepath.Join(dir, "snapshots.json"), 0)
+	for _, domain := range []string{"a.example.com", "B.example.com"} {
+		request := NewRequest(domain, startServer(t, ttlHandler(60, "name="+domain)))
+		request.Snapshots = store
+		if _, err := request.Get(); err != nil {
+			t.Fatalf("Expected response for %s, got: %v", domain, err)
+		}
+	}
+	snapshot, ok, err := store.Load("b.example.com.")
+	if err != nil || !ok {
+		t.Fatalf("Expected snapshot for b.example.com, got %v, %v", ok, err)
+	}
+	if len(snapshot.Attributes) != 1 || snapshot.Attributes[0].Value != "B.example.com" {
+		t.Errorf("Expected name=B.example.com, got %v", snapshot.Attributes)
+	}
+	if _, ok, _ = store.Load("c.example.com"); ok {
+		t.Errorf("Expected no snapshot for c.example.com")
+	}
+	// Only the snapshot file remains after the atomic writes
+	entries, _ := os.ReadDir(dir)
+	if len(entries) != 1 {
+		t.Errorf("Expected only the snapshot file, got %v", entries)
+	}
+}
+
+func TestSnapshotMissingFile(t *testing.T) {
+	store := NewSnapshotStore(filepath.Join(t.TempDir(), "missing.json"), 0)
+	if _, ok, err := store.Load("example.com"); ok || err != nil {
+		t.Errorf("Expected no snapshot and no error, got %v, %v", ok, err)
+	}
+}
+
+func TestSnapshotCorruptFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "snapshots.json")
+	if err := os.WriteFile(path, []byte(`{"example.com.": {"attrib`), 0o644); err != nil {
+		t.Fatalf("Failed to write snapshot file: %v", err)
+	}
+	store := NewSnapshotStore(path, 0)
+	if _, _, err := store.Load("example.com"); !errors.Is(err, ErrSnapshotCorrupt) {
+		t.Errorf("Expected ErrSnapshotCorrupt, got: %v", err)
+	}
+
+	request := NewRequest("example.com", startServer(t, ttlHandler(60, "color=blue")))
+	request.Snapshots = store
+	if _, err := request.Get(); err != nil {
+		t.Fatalf("Expected response, got: %v", err)
+	}
+	if err := store.LastError(); err != nil {
+		t.Errorf("Expected the corrupt file to be replaced, got: %v", err)
+	}
+	if snapshot, ok, err := store.Load("example.com"); err != nil || !ok || snapshot.Attributes[0].Value != "blue" {
+		t.Errorf("Expected new snapshot with color=blue, got %+v, %v, %v", snapshot, ok, err)
+	}
+	if data, err := os.ReadFile(path + ".corrupt"); err != nil || string(data) != `{"example.com.": {"attrib` {
+		t.Errorf("Expected the corrupt file to be kept aside, got %q, %v", data, err)
+	}
+}
+
+func TestSnapshotSaveError(t *testing.T) {
+	store := NewSnapshotStore(filepath.Join(t.TempDir(), "missing", "snapshots.json"), 0)
+	request := NewRequest("example.com", startServer(t, ttlHandler(60, "color=blue")))
+	request.Snapshots = store
+	if _, err := request.Get(); err != nil {
+		t.Fatalf("Expected the lookup to succeed despite the save failing, got: %v", err)
+	}
+	if err := store.LastError(); !errors.Is(err, fs.ErrNotExist) {
+		t.Errorf("Expected the save error to be reported, got: %v", err)
+	}
+}
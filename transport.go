@@ -0,0 +1,238 @@
+package dta
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// Transport is the protocol used to query a NameServer
+type Transport int
+
+const (
+	// TransportDNS queries over UDP, falling back to TCP when truncated
+	TransportDNS Transport = iota
+	// TransportTLS queries using DNS-over-TLS (RFC 7858)
+	TransportTLS
+	// TransportHTTPS queries using DNS-over-HTTPS (RFC 8484)
+	TransportHTTPS
+)
+
+const (
+	dohMediaType = "application/dns-message"
+	// Largest possible DNS message
+	maxMsgSize = 65535
+)
+
+// Returns the host:port to dial, filling in the transport's default port
+func (ns NameServer) address() string {
+	port := ns.Port
+	if port == 0 {
+		switch ns.Transport {
+		case TransportTLS:
+			port = 853
+		case TransportHTTPS:
+			port = 443
+		default:
+			port = 53
+		}
+	}
+	return net.JoinHostPort(ns.Host, strconv.Itoa(port))
+}
+
+// Identifies the nameserver in errors
+func (ns NameServer) endpoint() string {
+	if ns.Transport == TransportHTTPS && ns.URL != "" {
+		return ns.URL
+	}
+	return ns.address()
+}
+
+// Identifies the nameserver and how it's queried
+func (ns NameServer) key() string {
+	return strconv.Itoa(int(ns.Transport)) + "/" + ns.endpoint()
+}
+
+// Returns the TLS configuration for the nameserver. Unless a ServerName is
+// given, DNS-over-TLS verifies against Host and DNS-over-HTTPS against the URL.
+func (ns NameServer) tlsConfig() (config *tls.Config) {
+	if ns.TLSConfig != nil {
+		config = ns.TLSConfig.Clone()
+	} else {
+		config = new(tls.Config)
+	}
+	if config.ServerName == "" && ns.Transport == TransportTLS {
+		config.ServerName = ns.Host
+	}
+	return
+}
+
+// Sends the query to a single nameserver using its transport,
+// retrying over TCP if a UDP answer came back truncated
+func exchange(ctx context.Context, req request, m *dns.Msg, nameserver NameServer) (record *dns.Msg, err error) {
+	timeout := req.Timeout
+	if timeout <= 0 {
+		timeout = defaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	key := tsigKey(req, nameserver)
+	if key != nil {
+		m = signQuery(m, key)
+	}
+	if nameserver.Transport == TransportHTTPS {
+		return exchangeHTTPS(ctx, m, nameserver, key)
+	}
+	address := nameserver.address()
+	c := new(dns.Client)
+	if key != nil {
+		// The client verifies any signature on the answer with this secret
+		c.TsigSecret = map[string]string{key.name(): key.Secret}
+	}
+	switch {
+	case nameserver.Transport == TransportTLS:
+		c.Net = "tcp-tls"
+		c.TLSConfig = nameserver.tlsConfig()
+	case req.ForceTCP:
+		c.Net = "tcp"
+	}
+	record, _, err = c.ExchangeContext(ctx, m, address)
+	if err == nil && record.Truncated && c.Net == "" {
+		c.Net = "tcp"
+		if record, _, err = c.ExchangeContext(ctx, m, address); err != nil {
+			err = &kindError{kind: ErrTruncated, err: classifyError(err)}
+		}
+	}
+	if err == nil && record.Truncated {
+		record, err = nil, ErrTruncated
+	}
+	if err == nil && key != nil && record.IsTsig() == nil {
+		record, err = nil, ErrTSIGUnsigned
+	}
+	if err == nil && req.direct && !record.Authoritative {
+		record, err = nil, ErrNotAuthoritative
+	}
+	return
+}
+
+// Client for DNS-over-HTTPS nameservers without a TLSConfig or HTTPClient,
+// shared so connections stay open and are reused by later queries
+var defaultHTTPClient = newHTTPClient(new(tls.Config))
+
+func newHTTPClient(config *tls.Config) *http.Client {
+	return &http.Client{Transport: &http.Transport{
+		Proxy:             http.ProxyFromEnvironment,
+		TLSClientConfig:   config,
+		ForceAttemptHTTP2: true,
+	}}
+}
+
+// Returns the client for DNS-over-HTTPS queries to the nameserver.
+// temporary is set for a client built for a single query from TLSConfig,
+// whose connections should be closed afterwards.
+func (ns NameServer) httpClient() (client *http.Client, temporary bool) {
+	switch {
+	case ns.HTTPClient != nil:
+		return ns.HTTPClient, false
+	case ns.TLSConfig == nil:
+		return defaultHTTPClient, false
+	}
+	return newHTTPClient(ns.tlsConfig()), true
+}
+
+// Sends the query as an RFC 8484 wire-format request over HTTPS,
+// signing it and verifying the answer when key is set
+func exchangeHTTPS(ctx context.Context, m *dns.Msg, nameserver NameServer, key *TSIGKey) (record *dns.Msg, err error) {
+	// The ID is zeroed to keep GET requests cacheable
+	query := m.Copy()
+	query.Id = 0
+	var wire []byte
+	var requestMAC string
+	if key != nil {
+		wire, requestMAC, err = dns.TsigGenerate(query, key.Secret, "", false)
+	} else {
+		wire, err = query.Pack()
+	}
+	if err != nil {
+		return
+	}
+	endpoint := nameserver.URL
+	if endpoint == "" {
+		endpoint = "https://" + nameserver.address() + "/dns-query"
+	}
+	var httpReq *http.Request
+	switch strings.ToUpper(nameserver.HTTPMethod) {
+	case "", http.MethodPost:
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(wire))
+		if err == nil {
+			httpReq.Header.Set("Content-Type", dohMediaType)
+		}
+	case http.MethodGet:
+		var u *url.URL
+		if u, err = url.Parse(endpoint); err != nil {
+			return
+		}
+		values := u.Query()
+		values.Set("dns", base64.RawURLEncoding.EncodeToString(wire))
+		u.RawQuery = values.Encode()
+		httpReq, err = http.NewRequestWithContext(ctx, http.MethodGet, u.String(), nil)
+	default:
+		err = fmt.Errorf("unsupported DNS-over-HTTPS method: %s", nameserver.HTTPMethod)
+	}
+	if err != nil {
+		return
+	}
+	httpReq.Header.Set("Accept", dohMediaType)
+
+	client, temporary := nameserver.httpClient()
+	if temporary {
+		defer client.CloseIdleConnections()
+	}
+	resp, err := client.Do(httpReq)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	// The server didn't give an answer, as when a DNS server can't be reached
+	if resp.StatusCode != http.StatusOK {
+		err = &kindError{kind: ErrNetwork, err: fmt.Errorf("DNS-over-HTTPS server returned %s", resp.Status)}
+		return
+	}
+	contentType := resp.Header.Get("Content-Type")
+	if mediaType, _, _ := mime.ParseMediaType(contentType); mediaType != dohMediaType {
+		err = &kindError{kind: ErrNetwork, err: fmt.Errorf("DNS-over-HTTPS server returned unexpected content type: %s", contentType)}
+		return
+	}
+	body, err := io.ReadAll(io.LimitReader(resp.Body, maxMsgSize))
+	if err != nil {
+		return
+	}
+	record = new(dns.Msg)
+	if err = record.Unpack(body); err != nil {
+		record = nil
+		return
+	}
+	if key != nil {
+		if record.IsTsig() == nil {
+			record, err = nil, ErrTSIGUnsigned
+			return
+		}
+		if err = dns.TsigVerify(body, key.Secret, requestMAC, false); err != nil {
+			record = nil
+			return
+		}
+	}
+	record.Id = m.Id
+	return
+}
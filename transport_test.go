@@ -0,0 +1,326 @@
+package dta
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/base64"
+	"errors"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Test PKI with a CA issuing certificates for the loopback address
+type testPKI struct {
+	pool   *x509.CertPool
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	serial int64
+}
+
+func newTestPKI(t *testing.T) *testPKI {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "dnstxt-attrs test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		KeyUsage:              x509.KeyUsageCertSign,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("Failed to create CA certificate: %v", err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	pool := x509.NewCertPool()
+	pool.AddCert(cert)
+	return &testPKI{pool: pool, cert: cert, key: key, serial: 1}
+}
+
+// Issues a certificate valid for the given name and 127.0.0.1
+func (p *testPKI) issue(t *testing.T, name string, usage x509.ExtKeyUsage) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("Failed to generate key: %v", err)
+	}
+	p.serial++
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(p.serial),
+		Subject:      pkix.Name{CommonName: name},
+		DNSNames:     []string{name},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{usage},
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, p.cert, &key.PublicKey, p.key)
+	if err != nil {
+		t.Fatalf("Failed to create certificate: %v", err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+// Starts a DNS-over-TLS server on the loopback interface
+func startTLSServer(t *testing.T, config *tls.Config, handler dns.HandlerFunc) NameServer {
+	t.Helper()
+	l, err := tls.Listen("tcp", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatalf("Failed to listen: %v", err)
+	}
+	started := make(chan struct{})
+	server := &dns.Server{Listener: l, Net: "tcp-tls", Handler: handler, NotifyStartedFunc: func() { close(started) }}
+	go server.ActivateAndServe()
+	<-started
+	t.Cleanup(func() { server.Shutdown() })
+	return NameServer{Host: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port, Transport: TransportTLS}
+}
+
+func TestNameServerDefaultPorts(t *testing.T) {
+	if addr := (NameServer{Host: "192.0.2.1"}).address(); addr != "192.0.2.1:53" {
+		t.Errorf("Expected default DNS port, got: %s", addr)
+	}
+	if addr := (NameServer{Host: "192.0.2.1", Transport: TransportTLS}).address(); addr != "192.0.2.1:853" {
+		t.Errorf("Expected default DNS-over-TLS port, got: %s", addr)
+	}
+	if addr := (NameServer{Host: "2001:db8::1", Port: 5353}).address(); addr != "[2001:db8::1]:5353" {
+		t.Errorf("Expected explicit port, got: %s", addr)
+	}
+}
+
+func TestTLSTransport(t *testing.T) {
+	pki := newTestPKI(t)
+	nameserver := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{pki.issue(t, "dns.test", x509.ExtKeyUsageServerAuth)},
+	}, txtHandler("color=blue"))
+	nameserver.TLSConfig = &tls.Config{RootCAs: pki.pool, ServerName: "dns.test"}
+	res, err := NewRequest("example.com", nameserver).Get()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue, got %v", res.Config)
+	}
+}
+
+func TestTLSTransportVerifiesServerName(t *testing.T) {
+	pki := newTestPKI(t)
+	nameserver := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{pki.issue(t, "dns.test", x509.ExtKeyUsageServerAuth)},
+	}, txtHandler("color=blue"))
+	nameserver.TLSConfig = &tls.Config{RootCAs: pki.pool, ServerName: "other.test"}
+	if _, err := NewRequest("example.com", nameserver).Get(); err == nil {
+		t.Errorf("Expected error for mismatched server name")
+	}
+}
+
+func TestTLSTransportRejectsUnknownCA(t *testing.T) {
+	pki := newTestPKI(t)
+	nameserver := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{pki.issue(t, "dns.test", x509.ExtKeyUsageServerAuth)},
+	}, txtHandler("color=blue"))
+	// ServerName defaults to Host, which the certificate covers, so only the CA is at fault
+	if _, err := NewRequest("example.com", nameserver).Get(); err == nil {
+		t.Errorf("Expected error for certificate from unknown CA")
+	}
+}
+
+func TestTLSTransportClientCertificate(t *testing.T) {
+	pki := newTestPKI(t)
+	nameserver := startTLSServer(t, &tls.Config{
+		Certificates: []tls.Certificate{pki.issue(t, "dns.test", x509.ExtKeyUsageServerAuth)},
+		ClientCAs:    pki.pool,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+	}, txtHandler("color=blue"))
+	nameserver.TLSConfig = &tls.Config{RootCAs: pki.pool}
+	if _, err := NewRequest("example.com", nameserver).Get(); err == nil {
+		t.Errorf("Expected error without a client certificate")
+	}
+	nameserver.TLSConfig.Certificates = []tls.Certificate{pki.issue(t, "client.test", x509.ExtKeyUsageClientAuth)}
+	res, err := NewRequest("example.com", nameserver).Get()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue, got %v", res.Config)
+	}
+}
+
+// Adapts a DNS handler to an http.ResponseWriter for DNS-over-HTTPS tests
+type dohResponseWriter struct {
+	dns.ResponseWriter
+	reply *dns.Msg
+}
+
+func (w *dohResponseWriter) LocalAddr() net.Addr  { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (w *dohResponseWriter) RemoteAddr() net.Addr { return &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)} }
+func (w *dohResponseWriter) WriteMsg(m *dns.Msg) error {
+	w.reply = m
+	return nil
+}
+
+// Starts an RFC 8484 server that answers using handler and records the HTTP methods used
+func startDoHServer(t *testing.T, handler dns.HandlerFunc) (NameServer, chan string) {
+	t.Helper()
+	methods := make(chan string, 10)
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		methods <- r.Method
+		var wire []byte
+		var err error
+		switch r.Method {
+		case http.MethodGet:
+			wire, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != dohMediaType {
+				http.Error(rw, "bad content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			wire, err = io.ReadAll(r.Body)
+		}
+		query := new(dns.Msg)
+		if err == nil {
+			err = query.Unpack(wire)
+		}
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusBadRequest)
+			return
+		}
+		w := &dohResponseWriter{}
+		handler(w, query)
+		out, _ := w.reply.Pack()
+		rw.Header().Set("Content-Type", dohMediaType)
+		rw.Write(out)
+	}))
+	t.Cleanup(server.Close)
+	return NameServer{
+		Transport:  TransportHTTPS,
+		URL:        server.URL + "/dns-query",
+		HTTPClient: server.Client(),
+	}, methods
+}
+
+func TestHTTPSTransport(t *testing.T) {
+	for _, method := range []string{"", http.MethodPost, http.MethodGet} {
+		nameserver, methods := startDoHServer(t, txtHandler(largeEntries(40)...))
+		nameserver.HTTPMethod = method
+		res, err := NewRequest("example.com", nameserver).Get()
+		if err != nil {
+			t.Fatalf("Unexpected error using method %q: %v", method, err)
+		}
+		if len(res.Config) != 40 {
+			t.Errorf("Expected 40 attributes using method %q, got %d", method, len(res.Config))
+		}
+		expected := method
+		if expected == "" {
+			expected = http.MethodPost
+		}
+		if used := <-methods; used != expected {
+			t.Errorf("Expected %s request, got %s", expected, used)
+		}
+	}
+}
+
+func TestHTTPSTransportErrorStatus(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Error(rw, "unavailable", http.StatusServiceUnavailable)
+	}))
+	defer server.Close()
+	nameserver := NameServer{Transport: TransportHTTPS, URL: server.URL, HTTPClient: server.Client()}
+	_, err := NewRequest("example.com", nameserver).Get()
+	if err == nil || !strings.Contains(err.Error(), "503") {
+		t.Errorf("Expected error reporting the HTTP status, got: %v", err)
+	}
+	if !errors.Is(err, ErrNetwork) || !errors.Is(err, ErrAllServersFailed) {
+		t.Errorf("Expected error to match ErrNetwork and ErrAllServersFailed, got: %v", err)
+	}
+}
+
+func TestHTTPSTransportContentType(t *testing.T) {
+	for contentType, valid := range map[string]bool{
+		"application/dns-message":                true,
+		"application/dns-message; charset=utf-8": true,
+		"text/html":                              false,
+	} {
+		server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+			wire, _ := io.ReadAll(r.Body)
+			query := new(dns.Msg)
+			query.Unpack(wire)
+			w := &dohResponseWriter{}
+			txtHandler("color=blue")(w, query)
+			out, _ := w.reply.Pack()
+			rw.Header().Set("Content-Type", contentType)
+			rw.Write(out)
+		}))
+		nameserver := NameServer{Transport: TransportHTTPS, URL: server.URL, HTTPClient: server.Client()}
+		res, err := NewRequest("example.com", nameserver).Get()
+		server.Close()
+		if valid && (err != nil || res.Config["color"] != "blue") {
+			t.Errorf("Expected color=blue with content type %q, got %v, %v", contentType, res.Config, err)
+		}
+		if !valid && !errors.Is(err, ErrNetwork) {
+			t.Errorf("Expected ErrNetwork with content type %q, got: %v", contentType, err)
+		}
+	}
+}
+
+func TestHTTPSTransportUnsupportedMethod(t *testing.T) {
+	nameserver, _ := startDoHServer(t, txtHandler("color=blue"))
+	nameserver.HTTPMethod = http.MethodPut
+	if _, err := NewRequest("example.com", nameserver).Get(); err == nil {
+		t.Errorf("Expected error for unsupported method")
+	}
+}
+
+func TestHTTPSTransportUsesTLSConfig(t *testing.T) {
+	nameserver, _ := startDoHServer(t, txtHandler("color=blue"))
+	// Without an HTTPClient the server's CA has to come from TLSConfig
+	rootCAs := nameserver.HTTPClient.Transport.(*http.Transport).TLSClientConfig.RootCAs
+	nameserver.HTTPClient = nil
+	if _, err := NewRequest("example.com", nameserver).Get(); err == nil {
+		t.Errorf("Expected error for certificate from unknown CA")
+	}
+	nameserver.TLSConfig = &tls.Config{RootCAs: rootCAs}
+	res, err := NewRequest("example.com", nameserver).Get()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue, got %v", res.Config)
+	}
+}
+
+func TestHTTPSDefaultClientReused(t *testing.T) {
+	nameserver1 := NameServer{Transport: TransportHTTPS, Host: "192.0.2.1"}
+	nameserver2 := NameServer{Transport: TransportHTTPS, Host: "192.0.2.2"}
+	client1, temporary1 := nameserver1.httpClient()
+	client2, temporary2 := nameserver2.httpClient()
+	if client1 != client2 || temporary1 || temporary2 {
+		t.Errorf("Expected nameservers without a TLSConfig to share a client")
+	}
+	configured := NameServer{Transport: TransportHTTPS, Host: "192.0.2.1", TLSConfig: &tls.Config{}}
+	if client, temporary := configured.httpClient(); client == client1 || !temporary {
+		t.Errorf("Expected a client for the query with a TLSConfig")
+	}
+	custom := &http.Client{}
+	if client, temporary := (NameServer{HTTPClient: custom, TLSConfig: &tls.Config{}}).httpClient(); client != custom || temporary {
+		t.Errorf("Expected HTTPClient to be used when set")
+	}
+}
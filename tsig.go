@@ -0,0 +1,53 @@
+package dta
+
+import (
+	"errors"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Allowed difference between our clock and the signer's
+const tsigFudge = 300
+
+// ErrTSIGUnsigned is returned when a query was signed but the answer wasn't
+var ErrTSIGUnsigned = errors.New("TSIG signature missing from response")
+
+// TSIGKey is a shared secret used to authenticate queries and answers (RFC 8945)
+type TSIGKey struct {
+	// Name of the key as configured on the server
+	Name string
+	// Algorithm defaults to HMAC-SHA256
+	Algorithm string
+	// Secret is the base64 encoded shared secret
+	Secret string
+}
+
+// Returns the key name in the canonical form used for signing
+func (k *TSIGKey) name() string {
+	return strings.ToLower(dns.Fqdn(k.Name))
+}
+
+// Returns the algorithm name in the form used for signing
+func (k *TSIGKey) algorithm() string {
+	if k.Algorithm == "" {
+		return dns.HmacSHA256
+	}
+	return dns.Fqdn(strings.ToLower(k.Algorithm))
+}
+
+// Returns the key for queries to nameserver, if any
+func tsigKey(req request, nameserver NameServer) *TSIGKey {
+	if nameserver.TSIG != nil {
+		return nameserver.TSIG
+	}
+	return req.TSIG
+}
+
+// Returns a copy of m with a TSIG record ready to be signed with key
+func signQuery(m *dns.Msg, key *TSIGKey) *dns.Msg {
+	signed := m.Copy()
+	signed.SetTsig(key.name(), key.algorithm(), tsigFudge, time.Now().Unix())
+	return signed
+}
@@ -0,0 +1,160 @@
+package dta
+
+import (
+	"encoding/base64"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+var (
+	testTSIGSecret = base64.StdEncoding.EncodeToString([]byte("dnstxt-attrs test secret"))
+	testTSIGKey    = &TSIGKey{Name: "config-key", Secret: testTSIGSecret}
+)
+
+// Returns a handler that only answers queries carrying a valid TSIG signature
+func tsigHandler(handler dns.HandlerFunc) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		tsig := r.IsTsig()
+		if tsig == nil || w.TsigStatus() != nil {
+			m := new(dns.Msg)
+			m.SetRcode(r, dns.RcodeNotAuth)
+			w.WriteMsg(m)
+			return
+		}
+		handler(&tsigResponseWriter{ResponseWriter: w, tsig: tsig}, r)
+	}
+}
+
+// Signs every answer with the key used for the query
+type tsigResponseWriter struct {
+	dns.ResponseWriter
+	tsig *dns.TSIG
+}
+
+func (w *tsigResponseWriter) WriteMsg(m *dns.Msg) error {
+	m.SetTsig(w.tsig.Hdr.Name, w.tsig.Algorithm, tsigFudge, time.Now().Unix())
+	return w.ResponseWriter.WriteMsg(m)
+}
+
+func startTSIGServer(t *testing.T, secret string, handler dns.HandlerFunc) NameServer {
+	t.Helper()
+	return startServerWith(t, func(server *dns.Server) {
+		server.TsigSecret = map[string]string{"config-key.": secret}
+	}, tsigHandler(handler))
+}
+
+func TestTSIGSignedQuery(t *testing.T) {
+	request := NewRequest("example.com", startTSIGServer(t, testTSIGSecret, txtHandler("color=blue")))
+	request.TSIG = testTSIGKey
+	res, err := request.Get()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue, got %v", res.Config)
+	}
+}
+
+func TestTSIGNameServerKeyOverridesRequest(t *testing.T) {
+	nameserver := startTSIGServer(t, testTSIGSecret, txtHandler("color=blue"))
+	nameserver.TSIG = testTSIGKey
+	request := NewRequest("example.com", nameserver)
+	request.TSIG = &TSIGKey{Name: "config-key", Secret: base64.StdEncoding.EncodeToString([]byte("wrong"))}
+	if _, err := request.Get(); err != nil {
+		t.Errorf("Expected nameserver key to be used, got error: %v", err)
+	}
+}
+
+func TestTSIGUnsignedQueryRefused(t *testing.T) {
+	request := NewRequest("example.com", startTSIGServer(t, testTSIGSecret, txtHandler("color=blue")))
+	_, err := request.Get()
+	var rcodeErr *RcodeError
+	if !errors.As(err, &rcodeErr) || rcodeErr.Rcode != dns.RcodeNotAuth {
+		t.Errorf("Expected NOTAUTH error for unsigned query, got: %v", err)
+	}
+}
+
+func TestTSIGWrongSecret(t *testing.T) {
+	request := NewRequest("example.com", startTSIGServer(t, testTSIGSecret, txtHandler("color=blue")))
+	request.TSIG = &TSIGKey{Name: "config-key", Secret: base64.StdEncoding.EncodeToString([]byte("wrong"))}
+	if _, err := request.Get(); err == nil {
+		t.Errorf("Expected error when signing with the wrong secret")
+	}
+}
+
+func TestTSIGBadResponseMAC(t *testing.T) {
+	nameserver := startServer(t, func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		tsig := r.IsTsig()
+		m.Extra = append(m.Extra, &dns.TSIG{
+			Hdr:        dns.RR_Header{Name: tsig.Hdr.Name, Rrtype: dns.TypeTSIG, Class: dns.ClassANY},
+			Algorithm:  tsig.Algorithm,
+			TimeSigned: uint64(time.Now().Unix()),
+			Fudge:      tsigFudge,
+			MACSize:    32,
+			MAC:        "0000000000000000000000000000000000000000000000000000000000000000",
+			OrigId:     r.Id,
+		})
+		// Written raw so the server doesn't sign it properly
+		out, _ := m.Pack()
+		w.Write(out)
+	})
+	request := NewRequest("example.com", nameserver)
+	request.TSIG = testTSIGKey
+	if _, err := request.Get(); !errors.Is(err, dns.ErrSig) {
+		t.Errorf("Expected signature error, got: %v", err)
+	}
+}
+
+func TestTSIGUnsignedResponse(t *testing.T) {
+	request := NewRequest("example.com", startServer(t, txtHandler("color=blue")))
+	request.TSIG = testTSIGKey
+	_, err := request.Get()
+	if !errors.Is(err, ErrTSIGUnsigned) {
+		t.Errorf("Expected unsigned response error, got: %v", err)
+	}
+}
+
+func TestTSIGOverHTTPS(t *testing.T) {
+	server := httptest.NewTLSServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		wire, _ := io.ReadAll(r.Body)
+		query := new(dns.Msg)
+		query.Unpack(wire)
+		// Verification strips the TSIG record from the buffer, so it goes last
+		if err := dns.TsigVerify(wire, testTSIGSecret, "", false); err != nil {
+			http.Error(rw, err.Error(), http.StatusForbidden)
+			return
+		}
+		w := &dohResponseWriter{}
+		txtHandler("color=blue")(w, query)
+		tsig := query.IsTsig()
+		w.reply.SetTsig(tsig.Hdr.Name, tsig.Algorithm, tsigFudge, time.Now().Unix())
+		out, _, err := dns.TsigGenerate(w.reply, testTSIGSecret, tsig.MAC, false)
+		if err != nil {
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		rw.Header().Set("Content-Type", dohMediaType)
+		rw.Write(out)
+	}))
+	defer server.Close()
+	nameserver := NameServer{Transport: TransportHTTPS, URL: server.URL, HTTPClient: server.Client(), TSIG: testTSIGKey}
+	res, err := NewRequest("example.com", nameserver).Get()
+	if err != nil {
+		t.Fatalf("Unexpected error: %v", err)
+	}
+	if res.Config["color"] != "blue" {
+		t.Errorf("Expected color=blue, got %v", res.Config)
+	}
+	nameserver.TSIG = &TSIGKey{Name: "config-key", Secret: base64.StdEncoding.EncodeToString([]byte("wrong"))}
+	if _, err := NewRequest("example.com", nameserver).Get(); err == nil {
+		t.Errorf("Expected error when signing with the wrong secret")
+	}
+}
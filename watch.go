@@ -0,0 +1,173 @@
+package dta
+
+import (
+	"context"
+	"slices"
+	"strings"
+	"time"
+)
+
+// How often Watch re-queries when following TTLs and there's no usable TTL
+const defaultWatchInterval = 30 * time.Second
+
+// ChangeType is the kind of change reported by Watch
+type ChangeType int
+
+const (
+	// ChangeSnapshot carries the full set of attributes from the first lookup
+	ChangeSnapshot ChangeType = iota
+	// ChangeAdded reports an attribute that wasn't present before
+	ChangeAdded
+	// ChangeRemoved reports an attribute that's no longer present
+	ChangeRemoved
+	// ChangeModified reports an attribute whose values changed
+	ChangeModified
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangeSnapshot:
+		return "snapshot"
+	case ChangeAdded:
+		return "added"
+	case ChangeRemoved:
+		return "removed"
+	case ChangeModified:
+		return "modified"
+	}
+	return "unknown"
+}
+
+// Change is an update to a domain's attributes
+type Change struct {
+	Type ChangeType
+	// Name is the attribute that changed, with the spelling used in DNS.
+	// It's empty for snapshots.
+	Name string
+	// OldValues and Values are the attribute's values before and after the change
+	OldValues []string
+	Values    []string
+	// Response is the lookup the change was seen in
+	Response Response
+}
+
+// Watch looks up the domain every interval, or when the records' TTL
+// expires if interval is zero, and sends the changes to the attributes
+// compared with the previous lookup. The first successful lookup is sent
+// as a ChangeSnapshot. Failed lookups are retried at the next interval.
+// With CheckSerial set the TXT records are only fetched again when the
+// zone's serial changes. The channel is closed once ctx is done.
+func (req request) Watch(ctx context.Context, interval time.Duration) <-chan Change {
+	changes := make(chan Change)
+	go req.watch(ctx, interval, changes)
+	return changes
+}
+
+// The values of an attribute, grouped by name ignoring case
+type attributeValues struct {
+	name   string
+	values []string
+}
+
+func (req request) watch(ctx context.Context, interval time.Duration, changes chan<- Change) {
+	defer close(changes)
+	var current, pending map[string]attributeValues
+	var last Response
+	for {
+		var response Response
+		var err error
+		if req.CheckSerial && current != nil {
+			response, _, err = req.Refresh(ctx, last)
+		} else {
+			response, err = req.GetContext(ctx)
+		}
+		wait := watchInterval(interval, response, err)
+		if err == nil {
+			last = response
+			next := groupAttributes(response.Attributes)
+			switch {
+			case current == nil:
+				current = next
+				if !sendChange(ctx, changes, Change{Type: ChangeSnapshot, Response: response}) {
+					return
+				}
+			case len(diffAttributes(current, next, response)) == 0:
+				pending = nil
+			// Changes are only sent once a lookup Debounce later agrees
+			case req.Debounce > 0 && (pending == nil || len(diffAttributes(pending, next, response)) > 0):
+				pending = next
+				wait = req.Debounce
+			default:
+				for _, change := range diffAttributes(current, next, response) {
+					if !sendChange(ctx, changes, change) {
+						return
+					}
+				}
+				current, pending = next, nil
+			}
+		}
+		timer := time.NewTimer(wait)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		}
+	}
+}
+
+// Returns how long to wait before the next lookup
+func watchInterval(interval time.Duration, response Response, err error) time.Duration {
+	if interval > 0 {
+		return interval
+	}
+	if err != nil || response.TTL == 0 {
+		return defaultWatchInterval
+	}
+	return time.Duration(response.TTL) * time.Second
+}
+
+func sendChange(ctx context.Context, changes chan<- Change, change Change) bool {
+	select {
+	case changes <- change:
+		return true
+	case <-ctx.Done():
+		return false
+	}
+}
+
+func groupAttributes(attributes []Attribute) map[string]attributeValues {
+	grouped := make(map[string]attributeValues)
+	for _, attribute := range attributes {
+		key := strings.ToLower(attribute.Name)
+		group, ok := grouped[key]
+		if !ok {
+			group.name = attribute.Name
+		}
+		group.values = append(group.values, attribute.Value)
+		grouped[key] = group
+	}
+	return grouped
+}
+
+// Returns the changes from old to next ordered by name
+func diffAttributes(old, next map[string]attributeValues, response Response) (changes []Change) {
+	for key, group := range next {
+		previous, ok := old[key]
+		switch {
+		case !ok:
+			changes = append(changes, Change{Type: ChangeAdded, Name: group.name, Values: group.values, Response: response})
+		case !slices.Equal(previous.values, group.values):
+			changes = append(changes, Change{Type: ChangeModified, Name: group.name, OldValues: previous.values, Values: group.values, Response: response})
+		}
+	}
+	for key, group := range old {
+		if _, ok := next[key]; !ok {
+			changes = append(changes, Change{Type: ChangeRemoved, Name: group.name, OldValues: group.values, Response: response})
+		}
+	}
+	slices.SortFunc(changes, func(a, b Change) int {
+		return strings.Compare(strings.ToLower(a.Name), strings.ToLower(b.Name))
+	})
+	return
+}
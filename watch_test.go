@@ -0,0 +1,137 @@
+package dta
+
+import (
+	"context"
+	"slices"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// Returns a handler answering with the entries currently stored in entries
+func entriesHandler(entries *atomic.Value) dns.HandlerFunc {
+	return func(w dns.ResponseWriter, r *dns.Msg) {
+		txtHandler(entries.Load().([]string)...)(w, r)
+	}
+}
+
+// Waits for the next change, failing the test if none arrives
+func nextChange(t *testing.T, changes <-chan Change) Change {
+	t.Helper()
+	select {
+	case change, ok := <-changes:
+		if !ok {
+			t.Fatal("Expected a change, got closed channel")
+		}
+		return change
+	case <-time.After(2 * time.Second):
+		t.Fatal("Timed out waiting for a change")
+	}
+	return Change{}
+}
+
+func TestWatchChanges(t *testing.T) {
+	var entries atomic.Value
+	entries.Store([]string{"color=blue", "size=large", "shape=round"})
+	request := NewRequest("example.com", startServer(t, entriesHandler(&entries)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := request.Watch(ctx, 10*time.Millisecond)
+
+	snapshot := nextChange(t, changes)
+	if snapshot.Type != ChangeSnapshot || len(snapshot.Response.Attributes) != 3 {
+		t.Fatalf("Expected snapshot with 3 attributes, got %s %v", snapshot.Type, snapshot.Response.Attributes)
+	}
+
+	entries.Store([]string{"color=red", "shape=round", "weight=10"})
+	expected := []Change{
+		{Type: ChangeModified, Name: "color", OldValues: []string{"blue"}, Values: []string{"red"}},
+		{Type: ChangeRemoved, Name: "size", OldValues: []string{"large"}},
+		{Type: ChangeAdded, Name: "weight", Values: []string{"10"}},
+	}
+	for _, want := range expected {
+		got := nextChange(t, changes)
+		if got.Type != want.Type || got.Name != want.Name || !slices.Equal(got.OldValues, want.OldValues) || !slices.Equal(got.Values, want.Values) {
+			t.Errorf("Expected %s %s %v -> %v, got %s %s %v -> %v", want.Type, want.Name, want.OldValues, want.Values, got.Type, got.Name, got.OldValues, got.Values)
+		}
+	}
+}
+
+func TestWatchClosesOnCancel(t *testing.T) {
+	var entries atomic.Value
+	entries.Store([]string{"color=blue"})
+	request := NewRequest("example.com", startServer(t, entriesHandler(&entries)))
+	ctx, cancel := context.WithCancel(context.Background())
+	changes := request.Watch(ctx, 10*time.Millisecond)
+	nextChange(t, changes)
+	cancel()
+	select {
+	case _, ok := <-changes:
+		if ok {
+			t.Errorf("Expected no further changes after cancel")
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("Timed out waiting for the channel to close")
+	}
+}
+
+func TestWatchRetriesFailures(t *testing.T) {
+	var failing atomic.Bool
+	var entries atomic.Value
+	failing.Store(true)
+	entries.Store("color=blue")
+	request := NewRequest("example.com", startServer(t, switchableHandler(&entries, &failing)))
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := request.Watch(ctx, 10*time.Millisecond)
+	time.Sleep(30 * time.Millisecond)
+	failing.Store(false)
+	if change := nextChange(t, changes); change.Type != ChangeSnapshot || change.Response.Config["color"] != "blue" {
+		t.Errorf("Expected snapshot once lookups succeed, got %s %v", change.Type, change.Response.Config)
+	}
+}
+
+func TestWatchDebounce(t *testing.T) {
+	var entries atomic.Value
+	var lookups atomic.Int32
+	entries.Store([]string{"color=blue"})
+	handler := countingHandler(&lookups, entriesHandler(&entries))
+	request := NewRequest("example.com", startServer(t, handler))
+	request.Debounce = 200 * time.Millisecond
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	changes := request.Watch(ctx, 10*time.Millisecond)
+	nextChange(t, changes)
+
+	// Flap the value back before the debounce period ends
+	entries.Store([]string{"color=red"})
+	seen := lookups.Load()
+	for lookups.Load() <= seen {
+		time.Sleep(5 * time.Millisecond)
+	}
+	entries.Store([]string{"color=blue"})
+	select {
+	case change := <-changes:
+		t.Fatalf("Expected flapping value to be debounced, got %s %s %v", change.Type, change.Name, change.Values)
+	case <-time.After(300 * time.Millisecond):
+	}
+
+	entries.Store([]string{"color=green"})
+	if change := nextChange(t, changes); change.Type != ChangeModified || !slices.Equal(change.Values, []string{"green"}) {
+		t.Errorf("Expected color modified to green, got %s %v", change.Type, change.Values)
+	}
+}
+
+func TestWatchFollowsTTL(t *testing.T) {
+	var lookups atomic.Int32
+	request := NewRequest("example.com", startServer(t, countingHandler(&lookups, ttlHandler(1, "color=blue"))))
+	ctx, cancel := context.WithTimeout(context.Background(), 1500*time.Millisecond)
+	defer cancel()
+	for range request.Watch(ctx, 0) {
+	}
+	if got := lookups.Load(); got != 2 {
+		t.Errorf("Expected a lookup at start and after the 1s TTL, got %d", got)
+	}
+}
@@ -0,0 +1,55 @@
+package dta
+
+import "math/rand/v2"
+
+// Returns nameservers, which are ordered by priority, with the nameservers
+// of each priority in a weighted random order as described in RFC 2782.
+// Priorities where no nameserver has a weight keep their order.
+func weightedOrder(nameservers []NameServer, rnd *rand.Rand) []NameServer {
+	ordered := make([]NameServer, 0, len(nameservers))
+	for start := 0; start < len(nameservers); {
+		end := start + 1
+		for end < len(nameservers) && nameservers[end].Priority == nameservers[start].Priority {
+			end++
+		}
+		ordered = append(ordered, weightedTier(nameservers[start:end], rnd)...)
+		start = end
+	}
+	return ordered
+}
+
+// Orders nameservers of the same priority by repeatedly picking one at
+// random with a probability proportional to its weight. Nameservers
+// without a weight follow in their original order.
+func weightedTier(tier []NameServer, rnd *rand.Rand) []NameServer {
+	total := 0
+	for _, nameserver := range tier {
+		total += max(nameserver.Weight, 0)
+	}
+	if total == 0 {
+		return tier
+	}
+	remaining := append([]NameServer(nil), tier...)
+	picked := make([]NameServer, 0, len(tier))
+	for total > 0 {
+		n := randIntN(rnd, total)
+		running := 0
+		for i, nameserver := range remaining {
+			running += max(nameserver.Weight, 0)
+			if running > n {
+				picked = append(picked, nameserver)
+				total -= nameserver.Weight
+				remaining = append(remaining[:i], remaining[i+1:]...)
+				break
+			}
+		}
+	}
+	return append(picked, remaining...)
+}
+
+func randIntN(rnd *rand.Rand, n int) int {
+	if rnd == nil {
+		return rand.IntN(n)
+	}
+	return rnd.IntN(n)
+}
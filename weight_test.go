@@ -0,0 +1,101 @@
+package dta
+
+import (
+	"context"
+	"math/rand/v2"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func hosts(nameservers []NameServer) (hosts []string) {
+	for _, nameserver := range nameservers {
+		hosts = append(hosts, nameserver.Host)
+	}
+	return
+}
+
+func TestWeightedOrderUnweighted(t *testing.T) {
+	nameservers := []NameServer{{Host: "a", Priority: 1}, {Host: "b", Priority: 1}, {Host: "c", Priority: 2}}
+	got := hosts(weightedOrder(nameservers, rand.New(rand.NewPCG(1, 2))))
+	if got[0] != "a" || got[1] != "b" || got[2] != "c" {
+		t.Errorf("Expected unweighted nameservers to keep their order, got %v", got)
+	}
+}
+
+func TestWeightedOrderDeterministic(t *testing.T) {
+	nameservers := []NameServer{{Host: "a", Weight: 10}, {Host: "b", Weight: 20}, {Host: "c", Weight: 30}, {Host: "d", Weight: 40}}
+	for i := 0; i < 10; i++ {
+		first := hosts(weightedOrder(nameservers, rand.New(rand.NewPCG(uint64(i), 0))))
+		second := hosts(weightedOrder(nameservers, rand.New(rand.NewPCG(uint64(i), 0))))
+		for j := range first {
+			if first[j] != second[j] {
+				t.Fatalf("Expected the same order from the same seed, got %v and %v", first, second)
+			}
+		}
+	}
+}
+
+func TestWeightedOrderDistribution(t *testing.T) {
+	nameservers := []NameServer{{Host: "light", Priority: 1, Weight: 1}, {Host: "heavy", Priority: 1, Weight: 3}, {Host: "backup", Priority: 2, Weight: 100}}
+	rnd := rand.New(rand.NewPCG(1, 2))
+	heavy := 0
+	const runs = 4000
+	for i := 0; i < runs; i++ {
+		ordered := weightedOrder(nameservers, rnd)
+		if ordered[2].Host != "backup" {
+			t.Fatalf("Expected weights to apply within a priority only, got %v", hosts(ordered))
+		}
+		if ordered[0].Host == "heavy" {
+			heavy++
+		}
+	}
+	if share := float64(heavy) / runs; share < 0.7 || share > 0.8 {
+		t.Errorf("Expected the heavier nameserver first about 75%% of the time, got %.2f", share)
+	}
+}
+
+func TestWeightedOrderZeroWeight(t *testing.T) {
+	nameservers := []NameServer{{Host: "zero"}, {Host: "weighted", Weight: 1000}}
+	rnd := rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 100; i++ {
+		if ordered := weightedOrder(nameservers, rnd); ordered[0].Host != "weighted" {
+			t.Fatalf("Expected the zero weight nameserver last, got %v", hosts(ordered))
+		}
+	}
+}
+
+func TestWeightedLookups(t *testing.T) {
+	var lightQueries, heavyQueries atomic.Int32
+	light := startServer(t, countingHandler(&lightQueries, txtHandler("color=blue")))
+	light.Weight = 1
+	heavy := startServer(t, countingHandler(&heavyQueries, txtHandler("color=blue")))
+	heavy.Weight = 9
+	request := NewRequest("example.com", light, heavy)
+	request.Rand = rand.New(rand.NewPCG(1, 2))
+	for i := 0; i < 200; i++ {
+		if _, err := request.Get(); err != nil {
+			t.Fatalf("Expected response, got: %v", err)
+		}
+	}
+	if lightQueries.Load() == 0 || heavyQueries.Load() < 150 {
+		t.Errorf("Expected queries shared about 1:9, got %d and %d", lightQueries.Load(), heavyQueries.Load())
+	}
+}
+
+func TestHealthKeepsWeightedOrder(t *testing.T) {
+	tracker, _ := newTestHealthTracker(0, 0)
+	ctx := context.Background()
+	slow := NameServer{Host: "192.0.2.1", Weight: 1}
+	fast := NameServer{Host: "192.0.2.2", Weight: 1}
+	failing := NameServer{Host: "192.0.2.3", Weight: 1}
+	tracker.record(ctx, slow, new(dns.Msg), nil, time.Second)
+	tracker.record(ctx, fast, new(dns.Msg), nil, time.Millisecond)
+	tracker.record(ctx, failing, nil, ErrTimeout, 0)
+	got := hosts(tracker.order([]NameServer{failing, slow, fast}))
+	if got[0] != slow.Host || got[1] != fast.Host || got[2] != failing.Host {
+		t.Errorf("Expected only the failing nameserver to move, got %v", got)
+	}
+}